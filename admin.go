@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Admin API roles. The admin role implies readonly.
+const (
+	roleReadonly = "readonly"
+	roleAdmin    = "admin"
+)
+
+type AdminToken struct {
+	Token string `yaml:"token" secret:"true"`
+	Role  string `yaml:"role"`
+}
+
+type AdminTLS struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+	// AdminNames lists the client certificate common names granted the admin
+	// role. Other verified clients get the readonly role.
+	AdminNames []string `yaml:"adminNames"`
+}
+
+type adminServer struct {
+	config     Config
+	supervisor *supervisor
+}
+
+// validateAdmin checks the admin API settings. It refuses to serve without
+// some form of authentication, since the control endpoints can restart the
+// indexer.
+func validateAdmin(config Config) error {
+	for _, token := range config.AdminTokens {
+		if token.Token == "" {
+			return fmt.Errorf("adminTokens: empty token")
+		}
+		if token.Role != roleAdmin && token.Role != roleReadonly {
+			return fmt.Errorf("adminTokens: unknown role %q", token.Role)
+		}
+	}
+	if len(config.AdminTokens) == 0 && config.AdminTLS.ClientCAFile == "" {
+		return fmt.Errorf("adminAddr requires adminTokens or adminTLS.clientCAFile")
+	}
+	// Client certificates are only verified over TLS.
+	if config.AdminTLS.ClientCAFile != "" && (config.AdminTLS.CertFile == "" || config.AdminTLS.KeyFile == "") {
+		return fmt.Errorf("adminTLS.clientCAFile requires adminTLS.certFile and adminTLS.keyFile")
+	}
+	return nil
+}
+
+// serveAdmin listens on the admin address and serves the admin API in the
+// background. Like the metrics server, a server that stops later exits the
+// process.
+func serveAdmin(config Config, supervisor *supervisor) error {
+	if err := validateAdmin(config); err != nil {
+		return err
+	}
+
+	s := &adminServer{config: config, supervisor: supervisor}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.authorize(roleReadonly, http.MethodGet, s.handleStatus))
+	mux.HandleFunc("/pause", s.authorize(roleAdmin, http.MethodPost, s.handlePause))
+	mux.HandleFunc("/resume", s.authorize(roleAdmin, http.MethodPost, s.handleResume))
+	mux.HandleFunc("/restart", s.authorize(roleAdmin, http.MethodPost, s.handleRestart))
+
+	server := &http.Server{Addr: config.AdminAddr, Handler: mux}
+	if config.AdminTLS.CertFile != "" {
+		tlsConfig, err := adminTLSConfig(config)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	listener, err := net.Listen("tcp", config.AdminAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Printf("Serving admin API on %s", config.AdminAddr)
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(listener, config.AdminTLS.CertFile, config.AdminTLS.KeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		fatalf(exitFatal, "Admin API stopped: %v", err)
+	}()
+	return nil
+}
+
+func adminTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.AdminTLS.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(config.AdminTLS.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.AdminTLS.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	// With tokens configured a client certificate is optional, otherwise it
+	// is the only way to authenticate.
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(config.AdminTokens) > 0 {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// role returns the role of the caller, or "" if it could not be
+// authenticated.
+func (s *adminServer) role(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return ""
+		}
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, t := range s.config.AdminTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return t.Role
+			}
+		}
+		return ""
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && s.config.AdminTLS.ClientCAFile != "" {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, adminName := range s.config.AdminTLS.AdminNames {
+			if name == adminName {
+				return roleAdmin
+			}
+		}
+		return roleReadonly
+	}
+	return ""
+}
+
+func (s *adminServer) authorize(role, method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		callerRole := s.role(r)
+		if callerRole == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if role == roleAdmin && callerRole != roleAdmin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleStatus serves the status of the target named by the target query
+// parameter, or of all targets without one.
+func (s *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("target") != "" {
+		m, ok := s.targetMonitor(w, r)
+		if ok {
+			writeJSON(w, m.status())
+		}
+		return
+	}
+
+	statuses := []monitorStatus{}
+	for _, m := range s.supervisor.list() {
+		statuses = append(statuses, m.status())
+	}
+	writeJSON(w, statuses)
+}
+
+func (s *adminServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.targetMonitor(w, r)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(r.URL.Query().Get("for"))
+	if err != nil || d <= 0 {
+		http.Error(w, "query parameter \"for\" must be a positive duration", http.StatusBadRequest)
+		return
+	}
+	m.pause(d)
+	writeJSON(w, m.status())
+}
+
+func (s *adminServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.targetMonitor(w, r)
+	if !ok {
+		return
+	}
+	m.resume()
+	writeJSON(w, m.status())
+}
+
+func (s *adminServer) handleRestart(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.targetMonitor(w, r)
+	if !ok {
+		return
+	}
+	if err := m.forceRestart("the admin API"); err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, errRestartInProgress) {
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, m.status())
+}
+
+// targetMonitor looks up the monitor named by the target query parameter,
+// which may be omitted when only one target is configured.
+func (s *adminServer) targetMonitor(w http.ResponseWriter, r *http.Request) (*monitor, bool) {
+	m, err := s.supervisor.monitor(r.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return m, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing admin API response: %v", err)
+	}
+}
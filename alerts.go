@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []alertRule `yaml:"rules"`
+}
+
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// runGenAlerts implements the gen-alerts subcommand and returns the exit
+// code.
+func runGenAlerts(args []string) int {
+	flags := flag.NewFlagSet("gen-alerts", flag.ExitOnError)
+	group := flags.String("group", "near-lake-supervisor", "Name of the rule group")
+	restartLoop := flags.Int("restart-loop", 3, "Number of back-to-back restarts that make a restart loop")
+	flags.Parse(args)
+
+	config, err := LoadConfig("config")
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return exitConfig
+	}
+	targets, err := config.targetConfigs()
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return exitConfig
+	}
+
+	rules := ruleGroup{Name: *group}
+	for _, target := range targets {
+		rules.Rules = append(rules.Rules, targetAlertRules(config, target, *restartLoop)...)
+	}
+
+	fmt.Println("# Generated by near-lake-supervisor gen-alerts from the supervisor config.")
+	fmt.Println("# Regenerate after changing thresholds instead of editing by hand.")
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(ruleFile{Groups: []ruleGroup{rules}}); err != nil {
+		log.Printf("Failed to encode rules: %v", err)
+		return exitFatal
+	}
+	return exitOK
+}
+
+// targetAlertRules derives the alerts of one target from its thresholds.
+// They are a safety net for when the supervisor's own remediation does not
+// work, so each one only fires once the supervisor should already have
+// acted.
+func targetAlertRules(config Config, target TargetConfig, restartLoop int) []alertRule {
+	selector := fmt.Sprintf(`{target=%q}`, target.Name)
+	progress := "near_lake_supervisor_block_height"
+	if target.MetricMode == metricModeTimestamp {
+		progress = "near_lake_supervisor_block_timestamp_seconds"
+	}
+	labels := func(severity string) map[string]string {
+		return map[string]string{"severity": severity, "target": target.Name}
+	}
+
+	// The longest a healthy target goes without progress: a restart, its
+	// cooldown, and a full stall threshold before the next restart.
+	cycle := target.StallTimeout + target.RestartSleep
+	window := cycle + config.QueryInterval
+	if target.ResyncStallTimeout > target.StallTimeout {
+		window = target.ResyncStallTimeout + target.RestartSleep + config.QueryInterval
+	}
+
+	rules := []alertRule{
+		{
+			Alert: "NearLakeStalled",
+			// The threshold is exported rather than taken from the config, so
+			// that it follows known height ranges.
+			Expr: fmt.Sprintf("near_lake_supervisor_stall_seconds%s > on(target) near_lake_supervisor_stall_threshold_seconds%s unless on(target) near_lake_supervisor_resyncing%s == 1",
+				selector, selector, selector),
+			For:    promDuration(2 * config.QueryInterval),
+			Labels: labels("warning"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is stalled beyond its stall threshold", target.Name),
+				"description": "The block height of {{ $labels.target }} has not progressed for {{ $value | humanizeDuration }} and the supervisor's restarts have not fixed it.",
+			},
+		},
+		{
+			Alert:  "NearLakeNotProgressing",
+			Expr:   fmt.Sprintf("changes(%s%s[%s]) == 0", progress, selector, promDuration(window)),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s has not progressed for %v", target.Name, window),
+				"description": "The block height of {{ $labels.target }} has not changed for longer than a full stall, restart and cooldown cycle.",
+			},
+		},
+		{
+			Alert:  "NearLakeRestartLoop",
+			Expr:   fmt.Sprintf(`increase(near_lake_supervisor_restarts_total{target=%q,outcome="success"}[%s]) >= %d`, target.Name, promDuration(time.Duration(restartLoop)*cycle), restartLoop),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is in a restart loop", target.Name),
+				"description": "{{ $labels.target }} was restarted {{ $value }} times in a row; restarts are not fixing it.",
+			},
+		},
+		{
+			Alert:  "NearLakeRestartFailing",
+			Expr:   fmt.Sprintf(`increase(near_lake_supervisor_restarts_total{target=%q,outcome=~"failure|timeout"}[%s]) > 0`, target.Name, promDuration(window)),
+			Labels: labels("warning"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Restarts of %s are failing", target.Name),
+				"description": "The supervisor could not restart {{ $labels.target }}; check the history and Docker access.",
+			},
+		},
+		{
+			Alert:  "NearLakeSupervisorAbsent",
+			Expr:   fmt.Sprintf("absent(%s%s)", progress, selector),
+			For:    promDuration(5 * config.QueryInterval),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("No supervisor metrics for %s", target.Name),
+				"description": fmt.Sprintf("The supervisor is down, not scraped, or has not read the block height of %s once since it started.", target.Name),
+			},
+		},
+	}
+	if target.ReferenceRPC != "" && target.MetricMode == metricModeHeight && target.MaxBlocksBehind > 0 {
+		rules = append(rules, alertRule{
+			Alert:  "NearLakeBlocksBehind",
+			Expr:   fmt.Sprintf("near_lake_supervisor_blocks_behind%s > %d unless on(target) near_lake_supervisor_resyncing%s == 1", selector, target.MaxBlocksBehind, selector),
+			For:    promDuration(window),
+			Labels: labels("warning"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is more than %d blocks behind the network", target.Name, target.MaxBlocksBehind),
+				"description": "{{ $labels.target }} has trailed the reference head by {{ $value }} blocks for longer than a full stall, restart and cooldown cycle.",
+			},
+		})
+	}
+	if !target.Process.enabled() {
+		rules = append(rules, alertRule{
+			Alert:  "NearLakeCannotRemediate",
+			Expr:   fmt.Sprintf("near_lake_supervisor_runtime_up%s == 0", selector),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("The supervisor cannot restart %s", target.Name),
+				"description": "The container runtime of {{ $labels.target }} is unreachable, so stalls are not remediated until the Docker daemon or its socket is fixed.",
+			},
+		})
+	}
+	if target.Uploads.enabled() {
+		rules = append(rules, alertRule{
+			Alert:  "NearLakeUploadsFailing",
+			Expr:   fmt.Sprintf("near_lake_supervisor_uploads_up%s == 0", selector),
+			For:    promDuration(target.Uploads.FailureTimeout + target.RestartSleep),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("S3 uploads of %s are failing", target.Name),
+				"description": "The lake bucket of {{ $labels.target }} is falling behind while the local block height may still progress.",
+			},
+		})
+	}
+	for _, consumer := range target.Consumers {
+		rules = append(rules, alertRule{
+			Alert:  "NearLakeConsumerLagging",
+			Expr:   fmt.Sprintf("near_lake_supervisor_consumer_up{target=%q,consumer=%q} == 0", target.Name, consumer.Name),
+			For:    promDuration(consumer.LagTimeout),
+			Labels: labels("critical"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Consumer %s of %s is lagging", consumer.Name, target.Name),
+				"description": fmt.Sprintf("{{ $labels.consumer }} has been more than %d blocks behind {{ $labels.target }}, or unreadable, so the lake is not being consumed even though the indexer may be healthy.", consumer.MaxLag),
+			},
+		})
+	}
+	if target.Peer.enabled() {
+		rules = append(rules, alertRule{
+			Alert:  "NearLakePeerLagging",
+			Expr:   fmt.Sprintf("near_lake_supervisor_peer_lag_blocks%s > %d", selector, target.Peer.MaxLag),
+			For:    promDuration(target.Peer.LagTimeout + target.RestartSleep),
+			Labels: labels("warning"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is lagging behind its peer %s", target.Name, target.Peer.Target),
+				"description": "{{ $labels.target }} has trailed {{ $labels.peer }} by {{ $value }} blocks through a restart; {{ $labels.peer }} is authoritative.",
+			},
+		})
+	}
+	return rules
+}
+
+// promDuration formats d the way Prometheus durations are written, e.g.
+// 1h30m, rounded to seconds.
+func promDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d <= 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if n := d / unit.size; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, unit.suffix)
+			d -= n * unit.size
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	metricPrefix = "near_lake_supervisor_"
+
+	// cloudWatchBatchSize stays within the per-request limit of every
+	// PutMetricData API version.
+	cloudWatchBatchSize = 20
+	awsRequestTimeout   = 30 * time.Second
+)
+
+type CloudWatchConfig struct {
+	Namespace string        `yaml:"namespace"`
+	Region    string        `yaml:"region"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+type EventBridgeConfig struct {
+	BusName string `yaml:"busName"`
+	Source  string `yaml:"source"`
+	Region  string `yaml:"region"`
+}
+
+// awsExporter puts the supervisor's metrics into CloudWatch and publishes
+// restart events to EventBridge.
+type awsExporter struct {
+	config      Config
+	cloudwatch  *cloudwatch.Client
+	eventbridge *eventbridge.Client
+
+	// last holds the previously exported value of each counter series, as
+	// CloudWatch expects the change per period rather than a running total.
+	last map[string]float64
+
+	// pending tracks EventBridge publishes that are still in flight.
+	pending sync.WaitGroup
+}
+
+func newAWSExporter(config Config) (*awsExporter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsRequestTimeout)
+	defer cancel()
+
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &awsExporter{
+		config: config,
+		cloudwatch: cloudwatch.NewFromConfig(awsConfig, func(o *cloudwatch.Options) {
+			if config.CloudWatch.Region != "" {
+				o.Region = config.CloudWatch.Region
+			}
+		}),
+		eventbridge: eventbridge.NewFromConfig(awsConfig, func(o *eventbridge.Options) {
+			if config.EventBridge.Region != "" {
+				o.Region = config.EventBridge.Region
+			}
+		}),
+		last: make(map[string]float64),
+	}, nil
+}
+
+func (e *awsExporter) exportMetrics() {
+	log.Printf("Exporting metrics to CloudWatch namespace %s every %v", e.config.CloudWatch.Namespace, e.config.CloudWatch.Interval)
+	ticker := time.NewTicker(e.config.CloudWatch.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := e.putMetrics(); err != nil {
+			log.Printf("Error exporting metrics to CloudWatch: %v", err)
+		}
+	}
+}
+
+// putMetrics exports the current value of every supervisor gauge, and the
+// change since the last export of every counter and histogram.
+func (e *awsExporter) putMetrics() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	now := time.Now()
+	var data []cloudwatchtypes.MetricDatum
+	add := func(name string, metric *dto.Metric, value float64) {
+		data = append(data, cloudwatchtypes.MetricDatum{
+			MetricName: aws.String(cloudWatchName(name)),
+			Dimensions: cloudWatchDimensions(metric.GetLabel()),
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(value),
+		})
+	}
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, metricPrefix) {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, metric, metric.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, metric, e.delta(name, metric, metric.GetCounter().GetValue()))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				add(name+"_count", metric, e.delta(name+"_count", metric, float64(histogram.GetSampleCount())))
+				add(name+"_sum", metric, e.delta(name+"_sum", metric, histogram.GetSampleSum()))
+			}
+		}
+	}
+
+	for start := 0; start < len(data); start += cloudWatchBatchSize {
+		end := start + cloudWatchBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), awsRequestTimeout)
+		_, err := e.cloudwatch.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(e.config.CloudWatch.Namespace),
+			MetricData: data[start:end],
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *awsExporter) delta(name string, metric *dto.Metric, value float64) float64 {
+	key := name + metric.String()
+	delta := value - e.last[key]
+	e.last[key] = value
+	return delta
+}
+
+// cloudWatchName turns near_lake_supervisor_restarts_total into
+// RestartsTotal.
+func cloudWatchName(name string) string {
+	return camelCase(strings.TrimPrefix(name, metricPrefix))
+}
+
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func cloudWatchDimensions(labels []*dto.LabelPair) []cloudwatchtypes.Dimension {
+	dimensions := make([]cloudwatchtypes.Dimension, 0, len(labels))
+	for _, label := range labels {
+		dimensions = append(dimensions, cloudwatchtypes.Dimension{
+			Name:  aws.String(camelCase(label.GetName())),
+			Value: aws.String(label.GetValue()),
+		})
+	}
+	sort.Slice(dimensions, func(i, j int) bool {
+		return *dimensions[i].Name < *dimensions[j].Name
+	})
+	return dimensions
+}
+
+// eventBridgeDetailTypes are the detail types of the events published to
+// EventBridge, by history event type.
+var eventBridgeDetailTypes = map[string]string{
+	eventRestart:     "Indexer Restart",
+	eventUploads:     "Indexer Uploads",
+	eventConsumer:    "Indexer Consumer Lag",
+	eventPeer:        "Indexer Peer Lag",
+	eventImageUpdate: "Indexer Image Update",
+	eventRuntime:     "Indexer Cannot Remediate",
+}
+
+// record publishes restart and upload failure events to EventBridge. It does
+// not block the monitor; failures are logged.
+func (e *awsExporter) record(event historyEvent) {
+	detailType, ok := eventBridgeDetailTypes[event.Type]
+	if e.config.EventBridge.BusName == "" || !ok {
+		return
+	}
+
+	e.pending.Add(1)
+	go func() {
+		defer e.pending.Done()
+		detail, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding EventBridge event: %v", err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), awsRequestTimeout)
+		defer cancel()
+		output, err := e.eventbridge.PutEvents(ctx, &eventbridge.PutEventsInput{
+			Entries: []eventbridgetypes.PutEventsRequestEntry{{
+				EventBusName: aws.String(e.config.EventBridge.BusName),
+				Source:       aws.String(e.config.EventBridge.Source),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(string(detail)),
+				Time:         aws.Time(event.Time),
+			}},
+		})
+		if err == nil && output.FailedEntryCount > 0 {
+			err = fmt.Errorf("%s", aws.ToString(output.Entries[0].ErrorMessage))
+		}
+		if err != nil {
+			log.Printf("Error publishing %s event to EventBridge: %v", event.Type, err)
+		}
+	}()
+}
+
+// wait blocks until every event recorded so far has been published.
+func (e *awsExporter) wait() {
+	e.pending.Wait()
+}
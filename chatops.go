@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramAPI is the Telegram Bot API base URL.
+var telegramAPI = "https://api.telegram.org"
+
+var chatClient = &http.Client{Timeout: 70 * time.Second}
+
+const (
+	// telegramPollTimeout is how long a getUpdates long poll waits for new
+	// messages, and telegramRetryDelay the pause after a failed one.
+	telegramPollTimeout = 60 * time.Second
+	telegramRetryDelay  = 5 * time.Second
+	// chatCommandMaxAge is how old a command may be when it is received.
+	// Older ones, e.g. queued up while the supervisor was down, are ignored
+	// rather than acted on out of context.
+	chatCommandMaxAge = time.Minute
+)
+
+// chatReadonlyCommands are the commands the readonly role may use.
+var chatReadonlyCommands = map[string]bool{"help": true, "start": true, "status": true}
+
+const chatHelp = `Commands:
+status [target]
+pause [target] <duration>, e.g. pause mainnet 1h
+resume [target]
+restart [target] now
+The target may be omitted when only one is configured.`
+
+type ChatOpsConfig struct {
+	Telegram TelegramConfig `yaml:"telegram"`
+	Slack    SlackConfig    `yaml:"slack"`
+}
+
+// ChatUser grants the chat user with the platform's user ID a role, readonly
+// for status or admin for every command.
+type ChatUser struct {
+	ID   string `yaml:"id"`
+	Role string `yaml:"role"`
+}
+
+type TelegramConfig struct {
+	// Token is the bot token from @BotFather, empty disables the bot.
+	Token string `yaml:"token" secret:"true"`
+	// Chats, if set, restricts commands to these chat IDs.
+	Chats []int64    `yaml:"chats"`
+	Users []ChatUser `yaml:"users"`
+}
+
+type SlackConfig struct {
+	// Addr is the address to serve the slash command endpoint,
+	// /slack/command, on. Empty disables it.
+	Addr          string `yaml:"addr"`
+	SigningSecret string `yaml:"signingSecret" secret:"true"`
+	// Channels, if set, restricts commands to these channel IDs.
+	Channels []string   `yaml:"channels"`
+	Users    []ChatUser `yaml:"users"`
+}
+
+func (c ChatOpsConfig) enabled() bool {
+	return c.Telegram.Token != "" || c.Slack.Addr != ""
+}
+
+// validateChatOps checks the chat bot settings. Like the admin API, a bot
+// that would accept commands from anyone is refused.
+func validateChatOps(config ChatOpsConfig) error {
+	if config.Telegram.Token != "" {
+		if err := validateChatUsers("chatOps.telegram", config.Telegram.Users); err != nil {
+			return err
+		}
+	}
+	if config.Slack.Addr != "" {
+		if config.Slack.SigningSecret == "" {
+			return fmt.Errorf("chatOps.slack.signingSecret is required")
+		}
+		if err := validateChatUsers("chatOps.slack", config.Slack.Users); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateChatUsers(prefix string, users []ChatUser) error {
+	if len(users) == 0 {
+		return fmt.Errorf("%s.users: at least one user is required", prefix)
+	}
+	for _, user := range users {
+		if user.ID == "" {
+			return fmt.Errorf("%s.users: empty id", prefix)
+		}
+		if user.Role != roleAdmin && user.Role != roleReadonly {
+			return fmt.Errorf("%s.users: unknown role %q", prefix, user.Role)
+		}
+	}
+	return nil
+}
+
+// chatRole returns the role of the user with id, or "" for a stranger.
+func chatRole(users []ChatUser, id string) string {
+	for _, user := range users {
+		if user.ID == id {
+			return user.Role
+		}
+	}
+	return ""
+}
+
+// chatBot executes the commands authorized users send from chat, the same
+// operations the admin API offers.
+type chatBot struct {
+	supervisor *supervisor
+}
+
+// startChatOps starts the configured bots in the background. Like the admin
+// API, a Slack endpoint that stops later exits the process.
+func startChatOps(config ChatOpsConfig, supervisor *supervisor) error {
+	if err := validateChatOps(config); err != nil {
+		return err
+	}
+	b := &chatBot{supervisor: supervisor}
+	if config.Slack.Addr != "" {
+		if err := b.serveSlack(config.Slack); err != nil {
+			return err
+		}
+	}
+	if config.Telegram.Token != "" {
+		go b.pollTelegram(config.Telegram)
+	}
+	return nil
+}
+
+// execute runs the command in text for the user with role and sends the
+// result with reply, which a restart calls twice: once when it starts and
+// once with the outcome.
+func (b *chatBot) execute(platform, user, role, text string, reply func(string)) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		reply(chatHelp)
+		return
+	}
+	// Telegram sends /command@botname in group chats.
+	command := strings.ToLower(strings.TrimPrefix(fields[0], "/"))
+	if i := strings.Index(command, "@"); i >= 0 {
+		command = command[:i]
+	}
+	args := fields[1:]
+
+	if role == "" {
+		log.Printf("ChatOps: %s user %s is not authorized: %q", platform, user, text)
+		reply("You are not authorized to use this bot.")
+		return
+	}
+	if !chatReadonlyCommands[command] && role != roleAdmin {
+		log.Printf("ChatOps: %s user %s has no admin role: %q", platform, user, text)
+		reply(fmt.Sprintf("%s requires the admin role.", command))
+		return
+	}
+	log.Printf("ChatOps: %s user %s: %q", platform, user, text)
+
+	switch command {
+	case "help", "start":
+		reply(chatHelp)
+	case "status":
+		if len(args) > 1 {
+			reply("Usage: status [target]")
+			return
+		}
+		if len(args) == 1 {
+			m, err := b.supervisor.monitor(args[0])
+			if err != nil {
+				reply(err.Error())
+				return
+			}
+			reply(formatStatus(m.status()))
+			return
+		}
+		lines := []string{}
+		for _, m := range b.supervisor.list() {
+			lines = append(lines, formatStatus(m.status()))
+		}
+		reply(strings.Join(lines, "\n"))
+	case "pause":
+		m, rest, err := b.targetMonitor(args, 1)
+		if err != nil {
+			reply(fmt.Sprintf("Usage: pause [target] <duration>: %v", err))
+			return
+		}
+		d, err := time.ParseDuration(rest[0])
+		if err != nil || d <= 0 {
+			reply(fmt.Sprintf("%q is not a positive duration, e.g. 30m or 2h", rest[0]))
+			return
+		}
+		m.pause(d)
+		reply(formatStatus(m.status()))
+	case "resume":
+		m, _, err := b.targetMonitor(args, 0)
+		if err != nil {
+			reply(fmt.Sprintf("Usage: resume [target]: %v", err))
+			return
+		}
+		m.resume()
+		reply(formatStatus(m.status()))
+	case "restart":
+		m, rest, err := b.targetMonitor(args, 1)
+		if err != nil {
+			reply(fmt.Sprintf("Usage: restart [target] now: %v", err))
+			return
+		}
+		if rest[0] != "now" {
+			reply("Usage: restart [target] now")
+			return
+		}
+		reply(fmt.Sprintf("Restarting %s...", m.target))
+		if err := m.forceRestart(fmt.Sprintf("%s by %s", platform, user)); err != nil {
+			reply(fmt.Sprintf("Restart of %s failed: %v", m.target, err))
+			return
+		}
+		reply("Restarted: " + formatStatus(m.status()))
+	default:
+		reply(fmt.Sprintf("Unknown command %q.\n%s", command, chatHelp))
+	}
+}
+
+// targetMonitor looks up the monitor named by the first of args when there
+// are want arguments besides it, and the only one otherwise. It returns the
+// remaining arguments.
+func (b *chatBot) targetMonitor(args []string, want int) (*monitor, []string, error) {
+	name := ""
+	switch len(args) {
+	case want:
+	case want + 1:
+		name, args = args[0], args[1:]
+	default:
+		return nil, nil, fmt.Errorf("wrong number of arguments")
+	}
+	m, err := b.supervisor.monitor(name)
+	return m, args, err
+}
+
+// formatStatus renders a monitor status as one line of chat text.
+func formatStatus(status monitorStatus) string {
+	parts := []string{fmt.Sprintf("%s at %d", status.Target, status.BlockHeight)}
+	if status.BlockHeight < 0 {
+		parts[0] = status.Target + " has no reading yet"
+	}
+	if status.BlocksBehind != nil {
+		parts = append(parts, fmt.Sprintf("%d blocks behind", *status.BlocksBehind))
+	}
+	if status.StallSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("stalled for %v", (time.Duration(status.StallSeconds)*time.Second).Round(time.Second)))
+	}
+	if status.PausedUntil != nil {
+		parts = append(parts, "paused until "+status.PausedUntil.Format(time.RFC3339))
+	}
+	if status.CooldownUntil != nil {
+		parts = append(parts, "in cooldown until "+status.CooldownUntil.Format(time.RFC3339))
+	}
+	if status.Probe != "" {
+		parts = append(parts, "probe "+status.Probe)
+	}
+	if status.Runtime != "" {
+		parts = append(parts, "runtime "+status.Runtime)
+	}
+	if status.PeerLag != nil {
+		parts = append(parts, fmt.Sprintf("%d blocks behind peer %s", *status.PeerLag, status.Peer))
+	}
+	for name, consumer := range status.Consumers {
+		if consumer.Failure != "" {
+			parts = append(parts, fmt.Sprintf("consumer %s lagging: %s", name, consumer.Failure))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64  `json:"message_id"`
+	Date      int64  `json:"date"`
+	Text      string `json:"text"`
+	From      *struct {
+		ID int64 `json:"id"`
+	} `json:"from"`
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+}
+
+// pollTelegram receives messages to the bot with long polling and executes
+// the commands in them, one at a time.
+func (b *chatBot) pollTelegram(config TelegramConfig) {
+	log.Printf("ChatOps: polling Telegram for commands")
+	var offset int64
+	for {
+		var updates []telegramUpdate
+		err := telegramCall(config.Token, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			log.Printf("ChatOps: failed to get Telegram updates: %v", err)
+			time.Sleep(telegramRetryDelay)
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				b.handleTelegram(config, *update.Message)
+			}
+		}
+	}
+}
+
+func (b *chatBot) handleTelegram(config TelegramConfig, message telegramMessage) {
+	// Only commands: in a group the bot may see the whole conversation.
+	if !strings.HasPrefix(message.Text, "/") || message.From == nil {
+		return
+	}
+	if age := time.Since(time.Unix(message.Date, 0)); age > chatCommandMaxAge {
+		log.Printf("ChatOps: ignoring Telegram command sent %v ago: %q", age.Round(time.Second), message.Text)
+		return
+	}
+	user := strconv.FormatInt(message.From.ID, 10)
+	if len(config.Chats) > 0 && !containsChat(config.Chats, message.Chat.ID) {
+		log.Printf("ChatOps: ignoring Telegram command from chat %d: %q", message.Chat.ID, message.Text)
+		return
+	}
+	reply := func(text string) {
+		err := telegramCall(config.Token, "sendMessage", map[string]interface{}{
+			"chat_id":             message.Chat.ID,
+			"text":                text,
+			"reply_to_message_id": message.MessageID,
+		}, nil)
+		if err != nil {
+			log.Printf("ChatOps: failed to reply on Telegram: %v", err)
+		}
+	}
+	// Run aside from the poll loop, so that a restart does not hold up, and
+	// age out, the commands sent meanwhile.
+	go b.execute("Telegram", user, chatRole(config.Users, user), message.Text, reply)
+}
+
+func containsChat(chats []int64, id int64) bool {
+	for _, chat := range chats {
+		if chat == id {
+			return true
+		}
+	}
+	return false
+}
+
+// telegramCall calls a Bot API method with params and decodes its result into
+// result, if not nil. The token is part of the URL and is redacted from
+// errors.
+func telegramCall(token, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := chatClient.Post(fmt.Sprintf("%s/bot%s/%s", telegramAPI, token, method), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), token, "<redacted>"))
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("%s: failed to decode response with status %d: %w", method, resp.StatusCode, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("%s: %s", method, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// serveSlack listens on the Slack address and serves the slash command
+// endpoint in the background.
+func (b *chatBot) serveSlack(config SlackConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/command", b.handleSlack(config))
+	server := &http.Server{Addr: config.Addr, Handler: mux}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Printf("ChatOps: serving Slack commands on %s/slack/command", config.Addr)
+		fatalf(exitFatal, "Slack command endpoint stopped: %v", server.Serve(listener))
+	}()
+	return nil
+}
+
+type slackMessage struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text,omitempty"`
+}
+
+// handleSlack serves slash command requests. Slack expects an answer within
+// three seconds, so the command is acknowledged right away and its replies
+// are posted to the request's response URL.
+func (b *chatBot) handleSlack(config SlackConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := verifySlackSignature(config.SigningSecret, r.Header, body); err != nil {
+			log.Printf("ChatOps: rejected Slack request: %v", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if len(config.Channels) > 0 && !containsString(config.Channels, form.Get("channel_id")) {
+			writeJSON(w, slackMessage{ResponseType: "ephemeral", Text: "Commands are not accepted in this channel."})
+			return
+		}
+
+		user := form.Get("user_id")
+		responseURL := form.Get("response_url")
+		reply := func(text string) {
+			if err := postSlack(responseURL, slackMessage{ResponseType: "in_channel", Text: text}); err != nil {
+				log.Printf("ChatOps: failed to reply on Slack: %v", err)
+			}
+		}
+		// An in_channel acknowledgement shows the command itself to the
+		// channel, next to its replies.
+		writeJSON(w, slackMessage{ResponseType: "in_channel"})
+		go b.execute("Slack", user, chatRole(config.Users, user), form.Get("text"), reply)
+	}
+}
+
+// verifySlackSignature checks the request signature Slack computes with the
+// app's signing secret, and that the request is recent.
+func verifySlackSignature(secret string, header http.Header, body []byte) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); math.Abs(age.Seconds()) > chatCommandMaxAge.Seconds() {
+		return fmt.Errorf("timestamp %v off", age.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func postSlack(responseURL string, message slackMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := chatClient.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response URL returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySlackSignature(t *testing.T) {
+	const secret = "8f742231b10e8888abcd99yyyzzz85a5"
+	body := []byte("token=x&command=%2Fnear-lake&text=status")
+	sign := func(secret, timestamp string, body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":" + string(body)))
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-2*chatCommandMaxAge).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(2*chatCommandMaxAge).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		ok        bool
+	}{
+		{"valid", now, sign(secret, now, body), body, true},
+		{"missing timestamp", "", sign(secret, "", body), body, false},
+		{"malformed timestamp", "yesterday", sign(secret, "yesterday", body), body, false},
+		{"replayed", old, sign(secret, old, body), body, false},
+		{"from the future", future, sign(secret, future, body), body, false},
+		{"wrong secret", now, sign("other", now, body), body, false},
+		{"tampered body", now, sign(secret, now, body), []byte("token=x&command=%2Fnear-lake&text=restart"), false},
+		{"missing signature", now, "", body, false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.timestamp != "" {
+			header.Set("X-Slack-Request-Timestamp", test.timestamp)
+		}
+		if test.signature != "" {
+			header.Set("X-Slack-Signature", test.signature)
+		}
+		err := verifySlackSignature(secret, header, test.body)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verifySlackSignature() = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
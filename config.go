@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	IndexerURL    string            `yaml:"indexerURL"`
+	QueryInterval time.Duration     `yaml:"queryInterval"`
+	StartDelay    time.Duration     `yaml:"startDelay"`
+	StallTimeout  time.Duration     `yaml:"stallTimeout"`
+	RestartSleep  time.Duration     `yaml:"restartSleep"`
+	ContainerName string            `yaml:"containerName"`
+	MetricName    string            `yaml:"metricName"`
+	SourceType    string            `yaml:"sourceType"`
+	MetricsAddr   string            `yaml:"metricsAddr"`
+	HistoryFile   string            `yaml:"historyFile"`
+	StateFile     string            `yaml:"stateFile"`
+	ReferenceRPC  string            `yaml:"referenceRPC"`
+	AdminAddr     string            `yaml:"adminAddr"`
+	AdminTokens   []AdminToken      `yaml:"adminTokens"`
+	AdminTLS      AdminTLS          `yaml:"adminTLS"`
+	CloudWatch    CloudWatchConfig  `yaml:"cloudwatch"`
+	EventBridge   EventBridgeConfig `yaml:"eventBridge"`
+	SelfUpdate    SelfUpdateConfig  `yaml:"selfUpdate"`
+	ChatOps       ChatOpsConfig     `yaml:"chatOps"`
+	Targets       []TargetConfig    `yaml:"targets"`
+
+	FallbackSourceType     string                       `yaml:"fallbackSourceType"`
+	CloudWatchSource       CloudWatchSourceConfig       `yaml:"cloudwatchSource"`
+	LogsSource             LogsSourceConfig             `yaml:"logsSource"`
+	FileSource             FileSourceConfig             `yaml:"fileSource"`
+	RedisSource            RedisSourceConfig            `yaml:"redisSource"`
+	PostgresSource         PostgresSourceConfig         `yaml:"postgresSource"`
+	PrometheusServerSource PrometheusServerSourceConfig `yaml:"prometheusServerSource"`
+
+	KnownHeights    []KnownHeightRange `yaml:"knownHeights"`
+	KnownHeightsURL string             `yaml:"knownHeightsURL"`
+
+	ShardMetricName string `yaml:"shardMetricName"`
+	ShardLabel      string `yaml:"shardLabel"`
+
+	Probe       ProbeConfig       `yaml:"probe"`
+	Dependents  []DependentConfig `yaml:"dependents"`
+	Uploads     UploadsConfig     `yaml:"uploads"`
+	Consumers   []ConsumerConfig  `yaml:"consumers"`
+	ImageUpdate ImageUpdateConfig `yaml:"imageUpdate"`
+	Process     ProcessConfig     `yaml:"process"`
+
+	RestartTimeout           time.Duration `yaml:"restartTimeout"`
+	RestartTimeoutEscalation string        `yaml:"restartTimeoutEscalation"`
+
+	// Workers bounds the number of targets evaluated at the same time.
+	Workers           int           `yaml:"workers"`
+	EvaluationTimeout time.Duration `yaml:"evaluationTimeout"`
+
+	ResyncMinRegression int64         `yaml:"resyncMinRegression"`
+	ResyncStallTimeout  time.Duration `yaml:"resyncStallTimeout"`
+
+	ExpectedBlockTime   time.Duration `yaml:"expectedBlockTime"`
+	StallBlocks         int64         `yaml:"stallBlocks"`
+	ResyncStallBlocks   int64         `yaml:"resyncStallBlocks"`
+	ResyncCatchUpFactor float64       `yaml:"resyncCatchUpFactor"`
+
+	MetricMode  string        `yaml:"metricMode"`
+	MaxBlockAge time.Duration `yaml:"maxBlockAge"`
+
+	MaxBlocksBehind int64 `yaml:"maxBlocksBehind"`
+}
+
+// TargetConfig describes one supervised indexer. Fields left empty fall back
+// to the top-level setting of the same name.
+type TargetConfig struct {
+	Name          string        `yaml:"name"`
+	IndexerURL    string        `yaml:"indexerURL"`
+	StallTimeout  time.Duration `yaml:"stallTimeout"`
+	RestartSleep  time.Duration `yaml:"restartSleep"`
+	ContainerName string        `yaml:"containerName"`
+	MetricName    string        `yaml:"metricName"`
+	ReferenceRPC  string        `yaml:"referenceRPC"`
+
+	// MaxBlocksBehind is the distance from the reference head that the
+	// generated alert rules warn about.
+	MaxBlocksBehind int64 `yaml:"maxBlocksBehind"`
+
+	// SourceType selects where the block height is read from, with the
+	// matching settings in the field of the same name. FallbackSourceType,
+	// if set, is queried whenever SourceType fails.
+	SourceType             string                       `yaml:"sourceType"`
+	FallbackSourceType     string                       `yaml:"fallbackSourceType"`
+	CloudWatchSource       CloudWatchSourceConfig       `yaml:"cloudwatchSource"`
+	LogsSource             LogsSourceConfig             `yaml:"logsSource"`
+	FileSource             FileSourceConfig             `yaml:"fileSource"`
+	RedisSource            RedisSourceConfig            `yaml:"redisSource"`
+	PostgresSource         PostgresSourceConfig         `yaml:"postgresSource"`
+	PrometheusServerSource PrometheusServerSourceConfig `yaml:"prometheusServerSource"`
+
+	// KnownHeights relax stall detection in ranges of block heights known
+	// to pause, in addition to those listed at KnownHeightsURL.
+	KnownHeights    []KnownHeightRange `yaml:"knownHeights"`
+	KnownHeightsURL string             `yaml:"knownHeightsURL"`
+
+	// ShardMetricName, if set, is a per-shard height metric on IndexerURL
+	// whose series are told apart by ShardLabel. Each shard is checked for
+	// stalls of its own.
+	ShardMetricName string `yaml:"shardMetricName"`
+	ShardLabel      string `yaml:"shardLabel"`
+
+	Probe ProbeConfig `yaml:"probe"`
+	// Dependents are restarted together with ContainerName, in order.
+	Dependents []DependentConfig `yaml:"dependents"`
+	// Uploads watches the indexer's S3 upload counters.
+	Uploads UploadsConfig `yaml:"uploads"`
+	// Consumers are downstream consumers whose lag behind the block height
+	// is watched.
+	Consumers []ConsumerConfig `yaml:"consumers"`
+	// Peer cross-checks the target against a redundant one. It has no
+	// top-level counterpart.
+	Peer PeerConfig `yaml:"peer"`
+	// ImageUpdate rolls out new builds of the container's image.
+	ImageUpdate ImageUpdateConfig `yaml:"imageUpdate"`
+	// Process runs the indexer as a child process in place of
+	// ContainerName.
+	Process ProcessConfig `yaml:"process"`
+	// RestartTimeout bounds the whole restart, dependents and delays
+	// included. A restart that exceeds it is escalated according to
+	// RestartTimeoutEscalation: kill, or none.
+	RestartTimeout           time.Duration `yaml:"restartTimeout"`
+	RestartTimeoutEscalation string        `yaml:"restartTimeoutEscalation"`
+	// EvaluationTimeout bounds the queries of one evaluation, queryInterval
+	// by default.
+	EvaluationTimeout time.Duration `yaml:"evaluationTimeout"`
+
+	ResyncMinRegression int64         `yaml:"resyncMinRegression"`
+	ResyncStallTimeout  time.Duration `yaml:"resyncStallTimeout"`
+
+	// ExpectedBlockTime lets thresholds be given in blocks. StallBlocks and
+	// ResyncStallBlocks, when set, replace StallTimeout and
+	// ResyncStallTimeout with that many block intervals.
+	// ResyncCatchUpFactor, when set, treats progress that many times faster
+	// than one block per ExpectedBlockTime as a resync.
+	ExpectedBlockTime   time.Duration `yaml:"expectedBlockTime"`
+	StallBlocks         int64         `yaml:"stallBlocks"`
+	ResyncStallBlocks   int64         `yaml:"resyncStallBlocks"`
+	ResyncCatchUpFactor float64       `yaml:"resyncCatchUpFactor"`
+
+	// MetricMode is height, or timestamp for a metric that holds the unix
+	// time of the latest block. In timestamp mode the target is stalled once
+	// that block is older than MaxBlockAge, which replaces StallTimeout.
+	MetricMode  string        `yaml:"metricMode"`
+	MaxBlockAge time.Duration `yaml:"maxBlockAge"`
+}
+
+func LoadConfig(path string) (config Config, err error) {
+	viper.SetConfigType("yaml")
+
+	// Set defaults
+	viper.SetDefault("indexerURL", "http://indexer:3030")
+	viper.SetDefault("queryInterval", "30s")
+	viper.SetDefault("stallTimeout", "5m")
+	viper.SetDefault("restartSleep", "900s")
+	viper.SetDefault("restartTimeout", "30s")
+	viper.SetDefault("workers", 10)
+	viper.SetDefault("restartTimeoutEscalation", escalationKill)
+	viper.SetDefault("metricName", "near_indexer_streaming_current_block_height")
+	viper.SetDefault("containerName", "near-lake-indexer")
+	viper.SetDefault("sourceType", sourcePrometheus)
+	viper.SetDefault("metricMode", metricModeHeight)
+	viper.SetDefault("shardLabel", "shard_id")
+	viper.SetDefault("metricsAddr", ":9090")
+	viper.SetDefault("historyFile", "data/history.jsonl")
+	viper.SetDefault("stateFile", "data/state.json")
+	viper.SetDefault("maxBlocksBehind", 1000)
+	viper.SetDefault("resyncMinRegression", 1000)
+	viper.SetDefault("resyncStallTimeout", "1h")
+	viper.SetDefault("cloudwatch.interval", "1m")
+	viper.SetDefault("eventBridge.source", "near-lake-supervisor")
+	viper.SetDefault("selfUpdate.repo", "aurora-is-near/near-lake-supervisor")
+	viper.SetDefault("selfUpdate.checkInterval", "24h")
+
+	viper.AutomaticEnv()
+
+	file, err := findConfigFile(path)
+	if err != nil {
+		// If config file doesn't exist, use defaults
+		log.Printf("Config file not found, using defaults: %v", err)
+	} else {
+		data, err := readConfigFile(file)
+		if err != nil {
+			return config, err
+		}
+		if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+			return config, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+	}
+
+	err = viper.Unmarshal(&config)
+	if err != nil {
+		return
+	}
+
+	// Parse duration strings
+	if queryIntervalStr := viper.GetString("queryInterval"); queryIntervalStr != "" {
+		if d, err := time.ParseDuration(queryIntervalStr); err == nil {
+			config.QueryInterval = d
+		}
+	}
+	if stallTimeoutStr := viper.GetString("stallTimeout"); stallTimeoutStr != "" {
+		if d, err := time.ParseDuration(stallTimeoutStr); err == nil {
+			config.StallTimeout = d
+		}
+	}
+	if restartSleepStr := viper.GetString("restartSleep"); restartSleepStr != "" {
+		if d, err := time.ParseDuration(restartSleepStr); err == nil {
+			config.RestartSleep = d
+		}
+	}
+
+	_, err = config.targetConfigs()
+	return
+}
+
+// targetConfigs returns the configured targets with defaults applied. Without
+// a targets list the top-level settings describe a single target named after
+// its container.
+func (c Config) targetConfigs() ([]TargetConfig, error) {
+	targets := c.Targets
+	if len(targets) == 0 {
+		targets = []TargetConfig{{}}
+	}
+
+	if c.Workers < 1 {
+		return nil, fmt.Errorf("workers must be at least 1")
+	}
+	if c.QueryInterval <= 0 {
+		return nil, fmt.Errorf("queryInterval must be positive")
+	}
+	if c.CloudWatch.Namespace != "" && c.CloudWatch.Interval <= 0 {
+		return nil, fmt.Errorf("cloudwatch.interval must be positive")
+	}
+
+	seen := make(map[string]bool)
+	resolved := make([]TargetConfig, 0, len(targets))
+	for _, t := range targets {
+		if t.IndexerURL == "" {
+			t.IndexerURL = c.IndexerURL
+		}
+		if t.EvaluationTimeout == 0 {
+			t.EvaluationTimeout = c.EvaluationTimeout
+		}
+		if t.EvaluationTimeout == 0 {
+			t.EvaluationTimeout = c.QueryInterval
+		}
+		if t.StallTimeout == 0 {
+			t.StallTimeout = c.StallTimeout
+		}
+		if t.RestartSleep == 0 {
+			t.RestartSleep = c.RestartSleep
+		}
+		if t.ContainerName == "" {
+			t.ContainerName = c.ContainerName
+		}
+		if t.MetricName == "" {
+			t.MetricName = c.MetricName
+		}
+		if t.SourceType == "" {
+			t.SourceType = c.SourceType
+		}
+		if t.FallbackSourceType == "" {
+			t.FallbackSourceType = c.FallbackSourceType
+		}
+		if t.CloudWatchSource.Namespace == "" {
+			t.CloudWatchSource = c.CloudWatchSource
+		}
+		if t.LogsSource == (LogsSourceConfig{}) {
+			t.LogsSource = c.LogsSource
+		}
+		if t.FileSource == (FileSourceConfig{}) {
+			t.FileSource = c.FileSource
+		}
+		if t.RedisSource == (RedisSourceConfig{}) {
+			t.RedisSource = c.RedisSource
+		}
+		if t.PrometheusServerSource == (PrometheusServerSourceConfig{}) {
+			t.PrometheusServerSource = c.PrometheusServerSource
+		}
+		if t.PostgresSource == (PostgresSourceConfig{}) {
+			t.PostgresSource = c.PostgresSource
+		}
+		if t.RestartTimeout == 0 {
+			t.RestartTimeout = c.RestartTimeout
+		}
+		if t.RestartTimeoutEscalation == "" {
+			t.RestartTimeoutEscalation = c.RestartTimeoutEscalation
+		}
+		if t.Dependents == nil {
+			t.Dependents = c.Dependents
+		}
+		if t.KnownHeights == nil {
+			t.KnownHeights = c.KnownHeights
+		}
+		if t.KnownHeightsURL == "" {
+			t.KnownHeightsURL = c.KnownHeightsURL
+		}
+		if t.ShardMetricName == "" {
+			t.ShardMetricName = c.ShardMetricName
+		}
+		if t.ShardLabel == "" {
+			t.ShardLabel = c.ShardLabel
+		}
+		if t.Probe == (ProbeConfig{}) {
+			t.Probe = c.Probe
+		}
+		if t.Uploads == (UploadsConfig{}) {
+			t.Uploads = c.Uploads
+		}
+		if t.Consumers == nil {
+			t.Consumers = c.Consumers
+		}
+		if t.ImageUpdate.RecreateCommand == nil {
+			t.ImageUpdate = c.ImageUpdate
+		}
+		if t.Process.Command == nil {
+			t.Process = c.Process
+		}
+		if t.ReferenceRPC == "" {
+			t.ReferenceRPC = c.ReferenceRPC
+		}
+		if t.MaxBlocksBehind == 0 {
+			t.MaxBlocksBehind = c.MaxBlocksBehind
+		}
+		if t.ResyncMinRegression == 0 {
+			t.ResyncMinRegression = c.ResyncMinRegression
+		}
+		if t.ResyncStallTimeout == 0 {
+			t.ResyncStallTimeout = c.ResyncStallTimeout
+		}
+		if t.ExpectedBlockTime == 0 {
+			t.ExpectedBlockTime = c.ExpectedBlockTime
+		}
+		if t.StallBlocks == 0 {
+			t.StallBlocks = c.StallBlocks
+		}
+		if t.ResyncStallBlocks == 0 {
+			t.ResyncStallBlocks = c.ResyncStallBlocks
+		}
+		if t.ResyncCatchUpFactor == 0 {
+			t.ResyncCatchUpFactor = c.ResyncCatchUpFactor
+		}
+		if t.MetricMode == "" {
+			t.MetricMode = c.MetricMode
+		}
+		if t.MaxBlockAge == 0 {
+			t.MaxBlockAge = c.MaxBlockAge
+		}
+		if t.Name == "" {
+			t.Name = t.ContainerName
+		}
+		if t.StallBlocks > 0 || t.ResyncStallBlocks > 0 {
+			if t.ExpectedBlockTime <= 0 {
+				return nil, fmt.Errorf("target %q: stallBlocks and resyncStallBlocks require expectedBlockTime", t.Name)
+			}
+			if t.StallBlocks > 0 {
+				t.StallTimeout = time.Duration(t.StallBlocks) * t.ExpectedBlockTime
+			}
+			if t.ResyncStallBlocks > 0 {
+				t.ResyncStallTimeout = time.Duration(t.ResyncStallBlocks) * t.ExpectedBlockTime
+			}
+		}
+		if t.ResyncCatchUpFactor < 0 || (t.ResyncCatchUpFactor > 0 && t.ResyncCatchUpFactor <= 1) {
+			return nil, fmt.Errorf("target %q: resyncCatchUpFactor must be greater than 1", t.Name)
+		}
+		if t.ResyncCatchUpFactor > 0 && t.ExpectedBlockTime <= 0 {
+			return nil, fmt.Errorf("target %q: resyncCatchUpFactor requires expectedBlockTime", t.Name)
+		}
+		switch t.MetricMode {
+		case metricModeHeight:
+		case metricModeTimestamp:
+			if t.MaxBlockAge <= 0 {
+				return nil, fmt.Errorf("target %q: metricMode timestamp requires maxBlockAge", t.Name)
+			}
+			t.StallTimeout = t.MaxBlockAge
+		default:
+			return nil, fmt.Errorf("target %q: unknown metricMode %q", t.Name, t.MetricMode)
+		}
+		if err := t.Probe.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if t.Uploads.enabled() {
+			if t.Uploads.Action == "" {
+				t.Uploads.Action = uploadsNotify
+			}
+			if t.Uploads.FailureTimeout == 0 {
+				t.Uploads.FailureTimeout = t.StallTimeout
+			}
+		}
+		if err := t.Uploads.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if len(t.Consumers) > 0 && t.MetricMode != metricModeHeight {
+			return nil, fmt.Errorf("target %q: consumers require metricMode height", t.Name)
+		}
+		// Copied, as the defaults below must not leak into other targets
+		// inheriting the same list.
+		t.Consumers = append([]ConsumerConfig(nil), t.Consumers...)
+		consumerNames := make(map[string]bool)
+		for i := range t.Consumers {
+			consumer := &t.Consumers[i]
+			if consumer.SourceType == "" {
+				consumer.SourceType = sourcePrometheus
+			}
+			if consumer.Action == "" {
+				consumer.Action = consumerNotify
+			}
+			if consumer.LagTimeout == 0 {
+				consumer.LagTimeout = t.StallTimeout
+			}
+			if err := consumer.validate(); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Name, err)
+			}
+			if consumerNames[consumer.Name] {
+				return nil, fmt.Errorf("target %q: duplicate consumer %q", t.Name, consumer.Name)
+			}
+			consumerNames[consumer.Name] = true
+		}
+		if t.Peer.enabled() {
+			if t.Peer.LagTimeout == 0 {
+				t.Peer.LagTimeout = t.StallTimeout
+			}
+			if t.Peer.Target == t.Name {
+				return nil, fmt.Errorf("target %q: peer must be another target", t.Name)
+			}
+		}
+		if err := t.Peer.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if t.ImageUpdate.enabled() && t.ImageUpdate.CheckInterval == 0 {
+			t.ImageUpdate.CheckInterval = time.Hour
+		}
+		if err := t.ImageUpdate.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if t.Process.enabled() {
+			if t.Process.StopTimeout == 0 {
+				t.Process.StopTimeout = 30 * time.Second
+			}
+			if t.Process.RestartDelay == 0 {
+				t.Process.RestartDelay = 5 * time.Second
+			}
+			if t.ImageUpdate.enabled() || t.SourceType == sourceLogs || t.FallbackSourceType == sourceLogs {
+				return nil, fmt.Errorf("target %q: process mode cannot be combined with imageUpdate or the logs source", t.Name)
+			}
+		}
+		if err := t.Process.validate(); err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+		if t.RestartTimeout <= 0 {
+			return nil, fmt.Errorf("target %q: restartTimeout must be positive", t.Name)
+		}
+		if t.EvaluationTimeout <= 0 {
+			return nil, fmt.Errorf("target %q: evaluationTimeout must be positive", t.Name)
+		}
+		if t.RestartTimeoutEscalation != escalationKill && t.RestartTimeoutEscalation != escalationNone {
+			return nil, fmt.Errorf("target %q: unknown restartTimeoutEscalation %q", t.Name, t.RestartTimeoutEscalation)
+		}
+		for _, r := range t.KnownHeights {
+			if err := r.validate(); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Name, err)
+			}
+		}
+		for _, dependent := range t.Dependents {
+			if err := dependent.validate(); err != nil {
+				return nil, fmt.Errorf("target %q: %w", t.Name, err)
+			}
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+		resolved = append(resolved, t)
+	}
+	modes := make(map[string]string, len(resolved))
+	for _, t := range resolved {
+		modes[t.Name] = t.MetricMode
+	}
+	for _, t := range resolved {
+		if !t.Peer.enabled() {
+			continue
+		}
+		mode, ok := modes[t.Peer.Target]
+		if !ok {
+			return nil, fmt.Errorf("target %q: unknown peer target %q", t.Name, t.Peer.Target)
+		}
+		if t.MetricMode != metricModeHeight || mode != metricModeHeight {
+			return nil, fmt.Errorf("target %q: peer requires metricMode height on both targets", t.Name)
+		}
+	}
+	return resolved, nil
+}
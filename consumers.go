@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions on a lagging consumer.
+const (
+	consumerNotify  = "notify"
+	consumerCommand = "command"
+)
+
+// eventConsumer marks a downstream consumer starting to lag past its lag
+// timeout and catching up again, as well as the runs of its command.
+const eventConsumer = "consumer"
+
+// ConsumerConfig watches a downstream consumer of the lake, such as a
+// refiner, whose position has to keep up with the indexer. A healthy indexer
+// with a stuck consumer is an outage all the same.
+type ConsumerConfig struct {
+	Name string `yaml:"name"`
+	// SourceType is where the consumer's last processed block is read from:
+	// prometheus, the metric MetricName on URL's metrics endpoint, or
+	// prometheus-server, file, redis or postgres, configured like a target's
+	// height source.
+	SourceType             string                       `yaml:"sourceType"`
+	URL                    string                       `yaml:"url"`
+	MetricName             string                       `yaml:"metricName"`
+	PrometheusServerSource PrometheusServerSourceConfig `yaml:"prometheusServerSource"`
+	FileSource             FileSourceConfig             `yaml:"fileSource"`
+	RedisSource            RedisSourceConfig            `yaml:"redisSource"`
+	PostgresSource         PostgresSourceConfig         `yaml:"postgresSource"`
+	// MaxLag is how many blocks the consumer may trail the indexer by. Once
+	// it has been further behind, or unreadable, for LagTimeout, Action is
+	// taken: notify, or command, which runs Command.
+	MaxLag     int64         `yaml:"maxLag"`
+	LagTimeout time.Duration `yaml:"lagTimeout"`
+	Action     string        `yaml:"action"`
+	Command    []string      `yaml:"command"`
+}
+
+func (c ConsumerConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("consumers: name is required")
+	}
+	switch c.SourceType {
+	case sourcePrometheus:
+		if c.URL == "" || c.MetricName == "" {
+			return fmt.Errorf("consumer %q: url and metricName are required", c.Name)
+		}
+	case sourcePrometheusServer:
+		if c.MetricName == "" && c.PrometheusServerSource.Query == "" {
+			return fmt.Errorf("consumer %q: metricName or prometheusServerSource.query is required", c.Name)
+		}
+	case sourceFile, sourceRedis, sourcePostgres:
+	default:
+		return fmt.Errorf("consumer %q: unsupported sourceType %q", c.Name, c.SourceType)
+	}
+	if c.MaxLag <= 0 {
+		return fmt.Errorf("consumer %q: maxLag must be positive", c.Name)
+	}
+	switch c.Action {
+	case consumerNotify:
+	case consumerCommand:
+		if len(c.Command) == 0 {
+			return fmt.Errorf("consumer %q: the command action requires command", c.Name)
+		}
+	default:
+		return fmt.Errorf("consumer %q: unknown action %q", c.Name, c.Action)
+	}
+	return nil
+}
+
+// metricsTarget is the target label of the consumer's source query metrics.
+func (c ConsumerConfig) metricsTarget(target string) string {
+	return target + "/" + c.Name
+}
+
+// newConsumerSource builds the consumer's source from the height source of
+// the same type.
+func newConsumerSource(target string, c ConsumerConfig) (heightSource, error) {
+	source, err := newSourceOfType(TargetConfig{
+		Name:                   c.metricsTarget(target),
+		IndexerURL:             c.URL,
+		MetricName:             c.MetricName,
+		PrometheusServerSource: c.PrometheusServerSource,
+		FileSource:             c.FileSource,
+		RedisSource:            c.RedisSource,
+		PostgresSource:         c.PostgresSource,
+	}, c.SourceType)
+	if err != nil {
+		return nil, fmt.Errorf("consumer %q: %w", c.Name, err)
+	}
+	return source, nil
+}
+
+// consumerSource is a consumer with the source its position is read from.
+type consumerSource struct {
+	config ConsumerConfig
+	source heightSource
+}
+
+func newConsumerSources(config TargetConfig) ([]consumerSource, error) {
+	sources := make([]consumerSource, 0, len(config.Consumers))
+	for _, c := range config.Consumers {
+		source, err := newConsumerSource(config.Name, c)
+		if err != nil {
+			closeConsumerSources(sources)
+			return nil, err
+		}
+		sources = append(sources, consumerSource{config: c, source: source})
+	}
+	return sources, nil
+}
+
+func closeConsumerSources(sources []consumerSource) {
+	for _, s := range sources {
+		closeSource(s.source)
+	}
+}
+
+// consumerReading is a consumer's position read in a cycle.
+type consumerReading struct {
+	height int64
+	err    error
+}
+
+// queryConsumers reads the position of every consumer.
+func queryConsumers(ctx context.Context, sources []consumerSource) []consumerReading {
+	readings := make([]consumerReading, len(sources))
+	for i, s := range sources {
+		readings[i].height, readings[i].err = s.source.queryHeight(ctx)
+	}
+	return readings
+}
+
+// consumerState tracks a consumer across cycles. LaggingSince is when it
+// started to lag beyond maxLag, zero while it keeps up; Notified is set once
+// that has been recorded as an event.
+type consumerState struct {
+	Height       int64     `json:"height"`
+	Lag          int64     `json:"lag"`
+	LaggingSince time.Time `json:"laggingSince"`
+	Failure      string    `json:"failure,omitempty"`
+	Notified     bool      `json:"notified,omitempty"`
+}
+
+// checkConsumers compares the consumers' positions read in this cycle with
+// blockHeight and applies their lag policy. A consumer that cannot be read
+// counts as lagging, since it cannot be shown to keep up. The caller must
+// hold m.mu.
+func (m *monitor) checkConsumers(sources []consumerSource, readings []consumerReading, blockHeight int64) {
+	for i, s := range sources {
+		m.checkConsumer(s.config, readings[i], blockHeight)
+	}
+}
+
+func (m *monitor) checkConsumer(config ConsumerConfig, reading consumerReading, blockHeight int64) {
+	state := m.consumers[config.Name]
+	if state == nil {
+		state = &consumerState{}
+		m.consumers[config.Name] = state
+	}
+
+	var failure string
+	if reading.err != nil {
+		failure = fmt.Sprintf("failed to read position: %v", reading.err)
+	} else {
+		state.Height = reading.height
+		state.Lag = blockHeight - reading.height
+		if state.Lag < 0 {
+			state.Lag = 0
+		}
+		consumerLagGauge.WithLabelValues(m.target, config.Name).Set(float64(state.Lag))
+		if state.Lag > config.MaxLag {
+			failure = fmt.Sprintf("%d blocks behind the indexer at %d (max %d)", state.Lag, reading.height, config.MaxLag)
+		}
+	}
+
+	if failure == "" {
+		if !state.LaggingSince.IsZero() {
+			m.logf("Consumer %s caught up after lagging for %v", config.Name, time.Since(state.LaggingSince).Round(time.Second))
+			if state.Notified {
+				m.recordConsumer(config.Name, state, outcomeRecovered, "", "")
+			}
+		}
+		state.LaggingSince = time.Time{}
+		state.Failure = ""
+		state.Notified = false
+		consumerUpGauge.WithLabelValues(m.target, config.Name).Set(1)
+		return
+	}
+
+	if state.LaggingSince.IsZero() {
+		state.LaggingSince = time.Now()
+	}
+	state.Failure = failure
+	consumerUpGauge.WithLabelValues(m.target, config.Name).Set(0)
+	lagging := time.Since(state.LaggingSince)
+	m.logf("Consumer %s lagging for %v: %s", config.Name, lagging.Round(time.Second), failure)
+	if lagging < config.LagTimeout {
+		return
+	}
+
+	if !state.Notified {
+		m.recordConsumer(config.Name, state, outcomeFailing, "", failure)
+		state.Notified = true
+	}
+	if config.Action != consumerCommand {
+		return
+	}
+	m.logf("Consumer %s has been lagging for more than %v, running %s", config.Name, config.LagTimeout, strings.Join(config.Command, " "))
+	var output string
+	var err error
+	target, lag, timeout := m.target, state.Lag, m.config.RestartTimeout
+	m.unlocked(func() {
+		output, err = runConsumerCommand(target, config, lag, timeout)
+	})
+	// The consumer may have been removed from the config meanwhile.
+	if state = m.consumers[config.Name]; m.stopped || state == nil {
+		return
+	}
+	if output != "" {
+		m.logf("Consumer %s command output: %s", config.Name, output)
+	}
+	if err != nil {
+		m.logf("Error running the command of consumer %s: %v", config.Name, err)
+		m.recordConsumer(config.Name, state, outcomeFailure, consumerCommand, err.Error())
+	} else {
+		m.recordConsumer(config.Name, state, outcomeSuccess, consumerCommand, "")
+	}
+	// Give the consumer a full lag timeout to catch up after the command.
+	state.LaggingSince = time.Time{}
+	state.Notified = false
+}
+
+// runConsumerCommand runs the consumer's command within timeout, with the
+// target, the consumer and its lag in the environment, and returns its
+// output. It runs without m.mu, as the command may take as long as a restart.
+func runConsumerCommand(target string, config ConsumerConfig, lag int64, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.Command[0], config.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NEAR_LAKE_TARGET="+target,
+		"NEAR_LAKE_CONSUMER="+config.Name,
+		"NEAR_LAKE_CONSUMER_LAG="+strconv.FormatInt(lag, 10),
+	)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%s: %w", config.Command[0], ctx.Err())
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", config.Command[0], err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (m *monitor) recordConsumer(name string, state *consumerState, outcome, reason, failure string) {
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventConsumer,
+		BlockHeight: m.lastBlockHeight,
+		Consumer:    name,
+		Reason:      reason,
+		Outcome:     outcome,
+		Duration:    time.Since(state.LaggingSince),
+		Error:       failure,
+	})
+}
+
+// pruneConsumers drops the state and metrics of consumers no longer in the
+// config. The caller must hold m.mu.
+func (m *monitor) pruneConsumers() {
+	for name := range m.consumers {
+		found := false
+		for _, c := range m.config.Consumers {
+			found = found || c.Name == name
+		}
+		if !found {
+			delete(m.consumers, name)
+			consumerLagGauge.DeleteLabelValues(m.target, name)
+			consumerUpGauge.DeleteLabelValues(m.target, name)
+		}
+	}
+}
+
+// consumerLagTimeout returns the lag timeout of the named consumer. The
+// caller must hold m.mu.
+func (m *monitor) consumerLagTimeout(name string) time.Duration {
+	for _, c := range m.config.Consumers {
+		if c.Name == name {
+			return c.LagTimeout
+		}
+	}
+	return 0
+}
+
+// laggingConsumer returns the consumer that has been lagging the longest, if
+// any. The caller must hold m.mu.
+func (m *monitor) laggingConsumer() (string, *consumerState) {
+	var name string
+	var lagging *consumerState
+	for n, state := range m.consumers {
+		if state.LaggingSince.IsZero() {
+			continue
+		}
+		if lagging == nil || state.LaggingSince.Before(lagging.LaggingSince) {
+			name, lagging = n, state
+		}
+	}
+	return name, lagging
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckConsumer(t *testing.T) {
+	const lagTimeout = 5 * time.Minute
+	notify := ConsumerConfig{Name: "refiner", MaxLag: 50, LagTimeout: lagTimeout, Action: consumerNotify}
+	command := func(name string) ConsumerConfig {
+		config := notify
+		config.Action = consumerCommand
+		config.Command = []string{name}
+		return config
+	}
+	errUnreadable := errors.New("connection refused")
+
+	tests := []struct {
+		name         string
+		config       ConsumerConfig
+		reading      consumerReading
+		laggingSince time.Duration
+		notified     bool
+		lagging      bool
+		lag          int64
+		outcomes     []string
+	}{
+		{name: "within max lag", config: notify, reading: consumerReading{height: 960}, lag: 40},
+		{name: "ahead of the indexer", config: notify, reading: consumerReading{height: 1010}, lag: 0},
+		{name: "starts lagging", config: notify, reading: consumerReading{height: 900}, lagging: true, lag: 100},
+		{name: "lagging within the timeout", config: notify, reading: consumerReading{height: 900}, laggingSince: lagTimeout / 2, lagging: true, lag: 100},
+		{name: "lagging past the timeout", config: notify, reading: consumerReading{height: 900}, laggingSince: 2 * lagTimeout, lagging: true, lag: 100, outcomes: []string{outcomeFailing}},
+		{name: "still lagging", config: notify, reading: consumerReading{height: 900}, laggingSince: 2 * lagTimeout, notified: true, lagging: true, lag: 100},
+		{name: "unreadable", config: notify, reading: consumerReading{err: errUnreadable}, lagging: true},
+		{name: "unreadable past the timeout", config: notify, reading: consumerReading{err: errUnreadable}, laggingSince: 2 * lagTimeout, lagging: true, outcomes: []string{outcomeFailing}},
+		{name: "caught up", config: notify, reading: consumerReading{height: 990}, laggingSince: 2 * lagTimeout, notified: true, lag: 10, outcomes: []string{outcomeRecovered}},
+		{name: "caught up unnoticed", config: notify, reading: consumerReading{height: 990}, laggingSince: lagTimeout / 2, lag: 10},
+		{name: "command", config: command("true"), reading: consumerReading{height: 900}, laggingSince: 2 * lagTimeout, lag: 100, outcomes: []string{outcomeFailing, outcomeSuccess}},
+		{name: "failing command", config: command("false"), reading: consumerReading{height: 900}, laggingSince: 2 * lagTimeout, notified: true, lag: 100, outcomes: []string{outcomeFailure}},
+	}
+	for _, test := range tests {
+		m, events := newTestMonitor(TargetConfig{RestartTimeout: 10 * time.Second, Consumers: []ConsumerConfig{test.config}})
+		state := &consumerState{Notified: test.notified}
+		if test.laggingSince > 0 {
+			state.LaggingSince = time.Now().Add(-test.laggingSince)
+		}
+		m.consumers[test.config.Name] = state
+
+		m.mu.Lock()
+		m.checkConsumer(test.config, test.reading, 1000)
+		state = m.consumers[test.config.Name]
+		m.mu.Unlock()
+		if lagging := !state.LaggingSince.IsZero(); lagging != test.lagging {
+			t.Errorf("%s: lagging = %v, want %v", test.name, lagging, test.lagging)
+		}
+		if state.Lag != test.lag {
+			t.Errorf("%s: lag = %d, want %d", test.name, state.Lag, test.lag)
+		}
+		if outcomes := events.outcomes(); !reflect.DeepEqual(outcomes, test.outcomes) {
+			t.Errorf("%s: recorded %v, want %v", test.name, outcomes, test.outcomes)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+)
+
+// The subset of the Grafana dashboard model the generated dashboard uses.
+type dashboard struct {
+	Title         string         `json:"title"`
+	UID           string         `json:"uid"`
+	Description   string         `json:"description"`
+	Tags          []string       `json:"tags"`
+	SchemaVersion int            `json:"schemaVersion"`
+	Time          timeRange      `json:"time"`
+	Refresh       string         `json:"refresh"`
+	Templating    templateList   `json:"templating"`
+	Annotations   annotationList `json:"annotations"`
+	Panels        []panel        `json:"panels"`
+}
+
+type timeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type templateList struct {
+	List []templateVar `json:"list"`
+}
+
+type templateVar struct {
+	Name       string         `json:"name"`
+	Label      string         `json:"label"`
+	Type       string         `json:"type"`
+	Datasource *datasourceRef `json:"datasource,omitempty"`
+	Query      string         `json:"query"`
+	Definition string         `json:"definition,omitempty"`
+	Refresh    int            `json:"refresh"`
+	Multi      bool           `json:"multi"`
+	IncludeAll bool           `json:"includeAll"`
+}
+
+type annotationList struct {
+	List []annotation `json:"list"`
+}
+
+type annotation struct {
+	Name        string        `json:"name"`
+	Datasource  datasourceRef `json:"datasource"`
+	Enable      bool          `json:"enable"`
+	IconColor   string        `json:"iconColor"`
+	Expr        string        `json:"expr"`
+	Step        string        `json:"step"`
+	TitleFormat string        `json:"titleFormat"`
+	TextFormat  string        `json:"textFormat"`
+	TagKeys     string        `json:"tagKeys"`
+}
+
+type panel struct {
+	ID          int           `json:"id"`
+	Type        string        `json:"type"`
+	Title       string        `json:"title"`
+	Description string        `json:"description,omitempty"`
+	GridPos     gridPos       `json:"gridPos"`
+	Datasource  datasourceRef `json:"datasource"`
+	Targets     []panelQuery  `json:"targets"`
+	FieldConfig fieldConfig   `json:"fieldConfig"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type panelQuery struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+type fieldConfig struct {
+	Defaults fieldDefaults `json:"defaults"`
+}
+
+type fieldDefaults struct {
+	Unit   string      `json:"unit,omitempty"`
+	Min    *float64    `json:"min,omitempty"`
+	Max    *float64    `json:"max,omitempty"`
+	Custom fieldCustom `json:"custom"`
+}
+
+type fieldCustom struct {
+	DrawStyle         string `json:"drawStyle,omitempty"`
+	LineInterpolation string `json:"lineInterpolation,omitempty"`
+	FillOpacity       int    `json:"fillOpacity,omitempty"`
+}
+
+// runGenDashboard implements the gen-dashboard subcommand and returns the
+// exit code.
+func runGenDashboard(args []string) int {
+	flags := flag.NewFlagSet("gen-dashboard", flag.ExitOnError)
+	title := flags.String("title", "NEAR Lake Supervisor", "Dashboard title")
+	uid := flags.String("uid", "near-lake-supervisor", "Dashboard UID, which keeps re-imports from creating duplicates")
+	flags.Parse(args)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(newDashboard(*title, *uid)); err != nil {
+		log.Printf("Failed to encode dashboard: %v", err)
+		return exitFatal
+	}
+	return exitOK
+}
+
+// newDashboard lays out the supervisor's metrics for the targets selected in
+// the dashboard's target variable, with restarts as annotations on every
+// panel. The Prometheus data source is chosen on import.
+func newDashboard(title, uid string) dashboard {
+	source := datasourceRef{Type: "prometheus", UID: "${datasource}"}
+	zero, one := 0.0, 1.0
+
+	panels := []panel{
+		{
+			Title: "Block height",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_block_height{target=~"$target"}`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none"}},
+		},
+		{
+			Title:       "Blocks per second",
+			Description: "Rate at which the observed block height progresses. The height is a gauge, so a resync shows as a negative dip rather than a counter reset.",
+			Targets: []panelQuery{
+				{Expr: `deriv(near_lake_supervisor_block_height{target=~"$target"}[$__rate_interval])`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none"}},
+		},
+		{
+			Title:       "Blocks behind reference",
+			Description: "How far each target trails the reference head. Only reported for targets with referenceRPC set.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_blocks_behind{target=~"$target"}`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none", Min: &zero}},
+		},
+		{
+			Title:       "Consumer lag",
+			Description: "Blocks each downstream consumer trails its target by. Only reported for targets with consumers.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_consumer_lag_blocks{target=~"$target"}`, LegendFormat: "{{target}} {{consumer}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none", Min: &zero}},
+		},
+		{
+			Title:       "Peer lag",
+			Description: "Blocks each target trails its redundant peer by. Only reported for targets with a peer.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_peer_lag_blocks{target=~"$target"}`, LegendFormat: "{{target}} behind {{peer}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none", Min: &zero}},
+		},
+		{
+			Title:       "Stall duration",
+			Description: "Time since the block height last progressed. Drops back to 0 on progress or a successful restart.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_stall_seconds{target=~"$target"}`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "s", Min: &zero}},
+		},
+		{
+			Title: "Restarts",
+			Targets: []panelQuery{
+				{Expr: `sum by (target, reason, outcome) (increase(near_lake_supervisor_restarts_total{target=~"$target"}[$__rate_interval]))`, LegendFormat: "{{target}} {{reason}} ({{outcome}})"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "none", Min: &zero, Custom: fieldCustom{DrawStyle: "bars", FillOpacity: 80}}},
+		},
+		{
+			Title:       "Stall durations (p90, 6h)",
+			Description: "90th percentile of the stalls that ended in the last 6 hours, by progress resuming or a restart.",
+			Targets: []panelQuery{
+				{Expr: `histogram_quantile(0.9, sum by (target, le) (rate(near_lake_supervisor_stall_duration_seconds_bucket{target=~"$target"}[6h])))`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "s", Min: &zero}},
+		},
+		{
+			Title:       "Recovery durations (p90, 6h)",
+			Description: "90th percentile of the time from a successful restart until the block height progressed again.",
+			Targets: []panelQuery{
+				{Expr: `histogram_quantile(0.9, sum by (target, le) (rate(near_lake_supervisor_recovery_duration_seconds_bucket{target=~"$target"}[6h])))`, LegendFormat: "{{target}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "s", Min: &zero}},
+		},
+		{
+			Title:       "Source query latency (p90)",
+			Description: "Latency of the height queries by source and path, e.g. the indexer's query API (json) and exposition format (text).",
+			Targets: []panelQuery{
+				{Expr: `histogram_quantile(0.9, sum by (target, source, path, le) (rate(near_lake_supervisor_source_query_duration_seconds_bucket{target=~"$target"}[$__rate_interval])))`, LegendFormat: "{{target}} {{source}}/{{path}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "s", Min: &zero}},
+		},
+		{
+			Title:       "Source query errors",
+			Description: "Failed height queries per second by source and path.",
+			Targets: []panelQuery{
+				{Expr: `sum by (target, source, path) (rate(near_lake_supervisor_source_query_errors_total{target=~"$target"}[$__rate_interval]))`, LegendFormat: "{{target}} {{source}}/{{path}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "reqps", Min: &zero}},
+		},
+		{
+			Title:       "Shard stall duration",
+			Description: "Only reported for targets with shardMetricName set.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_shard_stall_seconds{target=~"$target"}`, LegendFormat: "{{target}} shard {{shard}}"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: "s", Min: &zero}},
+		},
+		{
+			Title:       "Liveness probe, uploads, runtime and resync",
+			Description: "Probe and uploads up (only for targets that check them), whether restarts reach the container runtime, and whether the target is catching up after a resync.",
+			Targets: []panelQuery{
+				{Expr: `near_lake_supervisor_probe_up{target=~"$target"}`, LegendFormat: "{{target}} probe up"},
+				{Expr: `near_lake_supervisor_uploads_up{target=~"$target"}`, LegendFormat: "{{target}} uploads up"},
+				{Expr: `near_lake_supervisor_runtime_up{target=~"$target"}`, LegendFormat: "{{target}} runtime up"},
+				{Expr: `near_lake_supervisor_resyncing{target=~"$target"}`, LegendFormat: "{{target}} resyncing"},
+			},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Min: &zero, Max: &one, Custom: fieldCustom{LineInterpolation: "stepAfter"}}},
+		},
+	}
+	// Two panels per row.
+	for i := range panels {
+		panels[i].ID = i + 1
+		panels[i].Type = "timeseries"
+		panels[i].Datasource = source
+		panels[i].GridPos = gridPos{H: 8, W: 12, X: i % 2 * 12, Y: i / 2 * 8}
+		for j := range panels[i].Targets {
+			panels[i].Targets[j].RefID = string(rune('A' + j))
+		}
+	}
+
+	return dashboard{
+		Title:         title,
+		UID:           uid,
+		Description:   "Generated by near-lake-supervisor gen-dashboard.",
+		Tags:          []string{"near", "near-lake-supervisor"},
+		SchemaVersion: 38,
+		Time:          timeRange{From: "now-24h", To: "now"},
+		Refresh:       "1m",
+		Templating: templateList{List: []templateVar{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{
+				Name:       "target",
+				Label:      "Target",
+				Type:       "query",
+				Datasource: &source,
+				// Every target exports the stall duration, unlike the block
+				// height, which timestamp mode does not.
+				Query:      "label_values(near_lake_supervisor_stall_seconds, target)",
+				Definition: "label_values(near_lake_supervisor_stall_seconds, target)",
+				// Refresh the target list when the time range changes.
+				Refresh:    2,
+				Multi:      true,
+				IncludeAll: true,
+			},
+		}},
+		Annotations: annotationList{List: []annotation{{
+			Name:        "Restarts",
+			Datasource:  source,
+			Enable:      true,
+			IconColor:   "red",
+			Expr:        `sum by (target, reason, outcome) (increase(near_lake_supervisor_restarts_total{target=~"$target"}[1m])) > 0`,
+			Step:        "1m",
+			TitleFormat: "Restart",
+			TextFormat:  "{{target}}: {{reason}} ({{outcome}})",
+			TagKeys:     "target,reason,outcome",
+		}}},
+		Panels: panels,
+	}
+}
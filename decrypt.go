@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+const ageHeader = "age-encryption.org/v1"
+
+// configCandidates are the file names LoadConfig looks for, in order. The
+// .age variants hold an age-encrypted YAML document.
+var configCandidates = []string{"local.yaml", "local.yml", "local.yaml.age", "local.yml.age"}
+
+func findConfigFile(dir string) (string, error) {
+	for _, name := range configCandidates {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %s found in %q", strings.Join(configCandidates, ", "), dir)
+}
+
+// readConfigFile returns the YAML contents of the config file at path,
+// decrypting it first if it is age-encrypted or a SOPS document.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if isAgeEncrypted(data) {
+		data, err = decryptAge(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+	}
+
+	if isSopsDocument(data) {
+		data, err = decryptSops(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+	}
+
+	return data, nil
+}
+
+func isAgeEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader)) ||
+		bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header))
+}
+
+// isSopsDocument reports whether data is a YAML document carrying SOPS
+// metadata, i.e. one whose values are encrypted in place.
+func isSopsDocument(data []byte) bool {
+	var document struct {
+		Sops map[string]interface{} `yaml:"sops"`
+	}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return false
+	}
+	return document.Sops != nil
+}
+
+// decryptAge decrypts data with the identities in AGE_KEY or AGE_KEY_FILE,
+// falling back to SOPS_AGE_KEY and SOPS_AGE_KEY_FILE so that the same key
+// works for both encryption styles.
+func decryptAge(data []byte) ([]byte, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	var ciphertext io.Reader = bytes.NewReader(data)
+	if !bytes.HasPrefix(data, []byte(ageHeader)) {
+		ciphertext = armor.NewReader(bytes.NewReader(bytes.TrimSpace(data)))
+	}
+	plaintext, err := age.Decrypt(ciphertext, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	for _, name := range []string{"AGE_KEY", "SOPS_AGE_KEY"} {
+		if key := os.Getenv(name); key != "" {
+			return age.ParseIdentities(strings.NewReader(key))
+		}
+	}
+	for _, name := range []string{"AGE_KEY_FILE", "SOPS_AGE_KEY_FILE"} {
+		if path := os.Getenv(name); path != "" {
+			file, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open %s: %w", name, err)
+			}
+			defer file.Close()
+			return age.ParseIdentities(bufio.NewReader(file))
+		}
+	}
+	return nil, fmt.Errorf("no age identity configured (set AGE_KEY or AGE_KEY_FILE)")
+}
+
+// decryptSops runs the sops binary, which handles every key type SOPS
+// supports and picks up its usual environment (SOPS_AGE_KEY_FILE, AWS
+// credentials, ...).
+func decryptSops(data []byte) ([]byte, error) {
+	cmd := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sops decrypt failed: %w, output: %s", err, stderr.String())
+	}
+	return output, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Exit codes. A terminating signal exits with 128 plus the signal number, as
+// a shell reports it. --output nagios uses the Nagios plugin states instead.
+const (
+	exitOK = 0
+	// exitFatal is a backend the supervisor cannot work without failing,
+	// such as a listener, the history file or the AWS setup.
+	exitFatal = 1
+	// exitUsage is an invalid command line, as the flag package reports it.
+	exitUsage = 2
+	// exitConfig is a config file that cannot be read, decrypted, parsed or
+	// validated.
+	exitConfig = 3
+)
+
+// exitHooks run before the supervisor exits on a signal or a fatal error,
+// such as stopping the indexer processes it runs.
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []func()
+)
+
+func onExit(hook func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+// runExitHooks runs the registered hooks once.
+func runExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// exit runs the exit hooks and exits with code.
+func exit(code int) {
+	runExitHooks()
+	os.Exit(code)
+}
+
+func fatalf(code int, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	exit(code)
+}
+
+// exitOnSignal exits with the signal's exit code on SIGINT or SIGTERM.
+func exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, exiting", sig)
+		exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
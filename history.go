@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// History event types.
+const (
+	eventStall    = "stall"
+	eventRestart  = "restart"
+	eventRecovery = "recovery"
+	eventResync   = "resync"
+	// eventKnownHeight marks entering and leaving a known height range, with
+	// the range as the reason.
+	eventKnownHeight = "known_height"
+	// eventUploads marks uploads starting to fail past their failure timeout
+	// and succeeding again.
+	eventUploads = "uploads"
+	// eventImageUpdate marks a new image waiting for the maintenance window.
+	eventImageUpdate = "image_update"
+)
+
+// Stall outcomes recorded in history, in addition to the restart outcomes.
+const (
+	outcomeResumed   = "resumed"
+	outcomeRestarted = "restarted"
+	outcomePaused    = "paused"
+	outcomeFailing   = "failing"
+	outcomeRecovered = "recovered"
+	outcomePending   = "pending"
+)
+
+// historyEvent is a single stall, restart, recovery or resync, persisted as
+// one JSON line in the history file.
+type historyEvent struct {
+	Time        time.Time     `json:"time"`
+	Target      string        `json:"target"`
+	Type        string        `json:"type"`
+	BlockHeight int64         `json:"blockHeight"`
+	Reason      string        `json:"reason,omitempty"`
+	Outcome     string        `json:"outcome,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	// Probe is the liveness probe result at the time of a restart.
+	Probe string `json:"probe,omitempty"`
+	// Shard is the stuck shard a shard_stall restart was for.
+	Shard string `json:"shard,omitempty"`
+	// BlocksBehind is how far the target trailed the reference head at its
+	// last successful reading, when a reference is configured.
+	BlocksBehind *int64 `json:"blocksBehind,omitempty"`
+	// Consumer is the downstream consumer a consumer event is about.
+	Consumer string `json:"consumer,omitempty"`
+	// Peer is the authoritative peer a peer event is about.
+	Peer string `json:"peer,omitempty"`
+	// Cycle is the ID of the evaluation cycle the event was recorded in, and
+	// Restart the ID of the restart it belongs to: the restart itself, the
+	// stall it ended, or the recovery after it.
+	Cycle   string `json:"cycle,omitempty"`
+	Restart string `json:"restart,omitempty"`
+}
+
+// eventSink receives the events monitors record.
+type eventSink interface {
+	record(event historyEvent)
+}
+
+// eventSinks fans events out to several sinks.
+type eventSinks []eventSink
+
+func (sinks eventSinks) record(event historyEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, sink := range sinks {
+		sink.record(event)
+	}
+}
+
+// historyStore appends events to a JSON lines file. A nil store discards
+// everything, which is what an empty historyFile configures.
+type historyStore struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openHistory(path string) (*historyStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	return &historyStore{file: file}, nil
+}
+
+func (h *historyStore) record(event historyEvent) {
+	if h == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding history event: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing history event: %v", err)
+	}
+}
+
+// readHistory returns the events in path recorded at or after since, oldest
+// first. Lines that fail to decode are skipped.
+func readHistory(path string, since time.Time) ([]historyEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []historyEvent
+	scanner := bufio.NewScanner(file)
+	// Events carry command output and errors, which may exceed the default
+	// 64 KiB line limit.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event historyEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.Time.Before(since) {
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return events, nil
+}
+
+// runHistory implements the history subcommand and returns the exit code.
+func runHistory(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	target := flags.String("target", "", "Only show events for this target")
+	since := flags.Duration("since", 24*time.Hour, "How far back to show events")
+	id := flags.String("id", "", "Only show events of this cycle or restart ID")
+	flags.Parse(args)
+
+	config, err := LoadConfig("config")
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return exitConfig
+	}
+	if config.HistoryFile == "" {
+		log.Printf("History is disabled (historyFile is empty)")
+		return exitConfig
+	}
+
+	events, err := readHistory(config.HistoryFile, time.Now().Add(-*since))
+	if err != nil {
+		log.Printf("Failed to read history: %v", err)
+		return exitFatal
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTARGET\tEVENT\tHEIGHT\tREASON\tOUTCOME\tDURATION\tCYCLE\tRESTART\tERROR")
+	for _, event := range events {
+		if *target != "" && event.Target != *target {
+			continue
+		}
+		if *id != "" && event.Cycle != *id && event.Restart != *id {
+			continue
+		}
+		duration := "-"
+		if event.Duration > 0 {
+			duration = event.Duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			event.Time.Local().Format(time.RFC3339),
+			event.Target,
+			event.Type,
+			event.BlockHeight,
+			orDash(event.Reason),
+			orDash(event.Outcome),
+			duration,
+			orDash(event.Cycle),
+			orDash(event.Restart),
+			orDash(event.Error),
+		)
+	}
+	w.Flush()
+	return exitOK
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
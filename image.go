@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// imagePullTimeout bounds an image update check, including the pull of a new
+// image.
+const imagePullTimeout = 10 * time.Minute
+
+// ImageUpdateConfig watches the image of the target's container for new
+// builds and rolls them out in a maintenance window.
+type ImageUpdateConfig struct {
+	// Image is the reference to watch, e.g. nearprotocol/near-lake:latest.
+	// It defaults to the image the container was created from.
+	Image         string        `yaml:"image"`
+	CheckInterval time.Duration `yaml:"checkInterval"`
+	// RecreateCommand recreates the container from the pulled image, e.g.
+	// docker compose up -d indexer, since docker restart keeps the image
+	// the container was created from.
+	RecreateCommand []string          `yaml:"recreateCommand"`
+	Window          MaintenanceWindow `yaml:"window"`
+}
+
+func (c ImageUpdateConfig) enabled() bool {
+	return len(c.RecreateCommand) > 0
+}
+
+func (c ImageUpdateConfig) validate() error {
+	if !c.enabled() {
+		if c.Image != "" || c.CheckInterval != 0 || !c.Window.isZero() {
+			return fmt.Errorf("imageUpdate: recreateCommand is required")
+		}
+		return nil
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("imageUpdate: checkInterval must be positive")
+	}
+	return c.Window.validate()
+}
+
+// MaintenanceWindow is a daily or weekly period in which disruptive changes
+// may be made. The zero window is always open.
+type MaintenanceWindow struct {
+	// Days lists the weekdays the window opens on, e.g. [sat, sun], and is
+	// every day when empty. Start is the time of day it opens, as HH:MM in
+	// UTC, and Duration how long it stays open.
+	Days     []string      `yaml:"days"`
+	Start    string        `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w MaintenanceWindow) isZero() bool {
+	return len(w.Days) == 0 && w.Start == "" && w.Duration == 0
+}
+
+func (w MaintenanceWindow) validate() error {
+	if w.isZero() {
+		return nil
+	}
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return fmt.Errorf("window: start must be HH:MM, got %q", w.Start)
+	}
+	if w.Duration <= 0 || w.Duration > 24*time.Hour {
+		return fmt.Errorf("window: duration must be between 0 and 24h")
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("window: unknown day %q", day)
+		}
+	}
+	return nil
+}
+
+// contains reports whether the window is open at t, including a window that
+// opened the day before and runs past midnight.
+func (w MaintenanceWindow) contains(t time.Time) bool {
+	if w.isZero() {
+		return true
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return false
+	}
+	t = t.UTC()
+	for _, daysAgo := range []int{0, 1} {
+		day := t.AddDate(0, 0, -daysAgo)
+		open := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, time.UTC)
+		if w.onDay(open.Weekday()) && !t.Before(open) && t.Before(open.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w MaintenanceWindow) onDay(weekday time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, day := range w.Days {
+		if weekdays[strings.ToLower(day)] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (w MaintenanceWindow) String() string {
+	if w.isZero() {
+		return "right away"
+	}
+	days := "daily"
+	if len(w.Days) > 0 {
+		days = strings.Join(w.Days, ",")
+	}
+	return fmt.Sprintf("in the %s %s UTC window (%v)", days, w.Start, w.Duration)
+}
+
+// refreshImage starts an image update check in the background when one is
+// due, as pulling a new image can take far longer than a cycle.
+func (m *monitor) refreshImage(config TargetConfig) {
+	if !config.ImageUpdate.enabled() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.imageChecking || time.Since(m.imageCheckedAt) < config.ImageUpdate.CheckInterval {
+		return
+	}
+	m.imageChecking = true
+	m.imageCheckedAt = time.Now()
+
+	m.imageCheck.Add(1)
+	go func() {
+		defer m.imageCheck.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), imagePullTimeout)
+		defer cancel()
+		image, id, err := checkImage(ctx, config)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.imageChecking = false
+		if m.stopped {
+			return
+		}
+		m.withoutCycle(func() {
+			if err != nil {
+				m.logf("Warning: Image update check failed: %v", err)
+				return
+			}
+			if id == "" || id == m.pendingImage {
+				return
+			}
+			m.pendingImage = id
+			m.logf("Pulled new image %s (%s), recreating the container %s", image, shortImageID(id), m.config.ImageUpdate.Window)
+			m.record(historyEvent{
+				Target:      m.target,
+				Type:        eventImageUpdate,
+				BlockHeight: m.lastBlockHeight,
+				Outcome:     outcomePending,
+				Reason:      image + "@" + shortImageID(id),
+			})
+		})
+	}()
+}
+
+// checkImage compares the registry's digest of the watched image with the
+// digests of the image the container runs, and pulls the image only when it
+// has changed. It returns the ID of a pulled image the container is not
+// running, or an empty ID when it is up to date.
+func checkImage(ctx context.Context, config TargetConfig) (image, id string, err error) {
+	image = config.ImageUpdate.Image
+	if image == "" {
+		image, err = dockerOutput(ctx, "inspect", "--format", "{{.Config.Image}}", config.ContainerName)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	running, err := dockerOutput(ctx, "inspect", "--format", "{{.Image}}", config.ContainerName)
+	if err != nil {
+		return image, "", err
+	}
+	remote, err := dockerOutput(ctx, "buildx", "imagetools", "inspect", "--format", "{{.Manifest.Digest}}", image)
+	if err != nil {
+		return image, "", err
+	}
+	repoDigests, err := dockerOutput(ctx, "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", running)
+	if err != nil {
+		return image, "", err
+	}
+	for _, repoDigest := range strings.Fields(repoDigests) {
+		if strings.HasSuffix(repoDigest, "@"+remote) {
+			return image, "", nil
+		}
+	}
+
+	if _, err := dockerOutput(ctx, "pull", "--quiet", image); err != nil {
+		return image, "", err
+	}
+	latest, err := dockerOutput(ctx, "image", "inspect", "--format", "{{.Id}}", image)
+	if err != nil {
+		return image, "", err
+	}
+	if latest == running {
+		return image, "", nil
+	}
+	return image, latest, nil
+}
+
+// applyImageUpdate recreates the container from a pulled image once the
+// maintenance window is open, and reports whether it did. The caller must
+// hold m.mu.
+func (m *monitor) applyImageUpdate() bool {
+	config := m.config.ImageUpdate
+	if m.pendingImage == "" || !config.enabled() || !config.Window.contains(time.Now()) {
+		return false
+	}
+	m.logf("Recreating container %s with image %s", m.config.ContainerName, shortImageID(m.pendingImage))
+	if err := m.restartWith(reasonImageUpdate, recreate); err != nil {
+		// The image stays pending, so that the next cycle in the window
+		// retries the update.
+		return true
+	}
+	m.pendingImage = ""
+	return true
+}
+
+// recreate runs the image update's recreate command.
+func recreate(ctx context.Context, config TargetConfig) error {
+	command := config.ImageUpdate.RecreateCommand
+	tracef(ctx, "Running %s", strings.Join(command, " "))
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", command[0], ctx.Err())
+	}
+	if err != nil {
+		return commandError(command[0], err, output)
+	}
+	return nil
+}
+
+// shortImageID shortens an image ID like docker images does.
+func shortImageID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
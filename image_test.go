@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	// 2026-10-12 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	daily := MaintenanceWindow{Start: "03:00", Duration: 2 * time.Hour}
+	overnight := MaintenanceWindow{Days: []string{"mon"}, Start: "23:00", Duration: 2 * time.Hour}
+
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		at     time.Time
+		want   bool
+	}{
+		{"no window", MaintenanceWindow{}, at(12, 12, 0), true},
+		{"before start", daily, at(12, 2, 59), false},
+		{"at start", daily, at(12, 3, 0), true},
+		{"inside", daily, at(12, 4, 30), true},
+		{"at end", daily, at(12, 5, 0), false},
+		{"other day", MaintenanceWindow{Days: []string{"Tue"}, Start: "03:00", Duration: time.Hour}, at(12, 3, 30), false},
+		{"listed day", MaintenanceWindow{Days: []string{"Tue"}, Start: "03:00", Duration: time.Hour}, at(13, 3, 30), true},
+		{"overnight before midnight", overnight, at(12, 23, 30), true},
+		{"overnight after midnight", overnight, at(13, 0, 30), true},
+		{"overnight after the end", overnight, at(13, 1, 0), false},
+		{"overnight from an unlisted day", overnight, at(14, 0, 30), false},
+		{"other time zone", daily, at(12, 4, 0).In(time.FixedZone("UTC+10", 10*3600)), true},
+		{"malformed start", MaintenanceWindow{Start: "3am", Duration: time.Hour}, at(12, 3, 0), false},
+	}
+	for _, test := range tests {
+		if got := test.window.contains(test.at); got != test.want {
+			t.Errorf("%s: contains(%v) = %v, want %v", test.name, test.at, got, test.want)
+		}
+	}
+}
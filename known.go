@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// knownHeightsRefresh is how often a knownHeightsURL list is fetched again.
+const knownHeightsRefresh = time.Hour
+
+// stallSuppressed is the stall threshold inside a range that suppresses
+// stall detection altogether.
+const stallSuppressed = time.Duration(math.MaxInt64)
+
+// Known height range events recorded in history.
+const (
+	outcomeEntered = "entered"
+	outcomeLeft    = "left"
+)
+
+// KnownHeightRange is a range of block heights, such as a protocol upgrade,
+// where the node reliably pauses for longer than its stall threshold.
+type KnownHeightRange struct {
+	From int64 `yaml:"from"`
+	To   int64 `yaml:"to"`
+	// StallTimeout replaces the stall threshold within the range when it is
+	// longer. Suppress disables stall detection within the range instead.
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+	Suppress     bool          `yaml:"suppress"`
+	Note         string        `yaml:"note"`
+}
+
+func (r KnownHeightRange) contains(height int64) bool {
+	return height >= r.From && height <= r.To
+}
+
+func (r KnownHeightRange) String() string {
+	s := fmt.Sprintf("%d-%d", r.From, r.To)
+	if r.Note != "" {
+		s += fmt.Sprintf(" (%s)", r.Note)
+	}
+	return s
+}
+
+func (r KnownHeightRange) validate() error {
+	if r.To < r.From {
+		return fmt.Errorf("knownHeights: range %d-%d ends before it starts", r.From, r.To)
+	}
+	return nil
+}
+
+// fetchKnownHeights reads a list of ranges, in YAML or JSON, from url.
+func fetchKnownHeights(ctx context.Context, url string) ([]KnownHeightRange, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch known heights: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("known heights URL returned status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known heights: %w", err)
+	}
+
+	var ranges []KnownHeightRange
+	if err := yaml.Unmarshal(data, &ranges); err != nil {
+		return nil, fmt.Errorf("failed to parse known heights: %w", err)
+	}
+	for _, r := range ranges {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// refreshKnownHeights fetches the target's knownHeightsURL list within the
+// cycle's ctx when it is due. The previous list is kept when fetching fails.
+func (m *monitor) refreshKnownHeights(ctx context.Context, config TargetConfig) {
+	if config.KnownHeightsURL == "" {
+		return
+	}
+	m.mu.Lock()
+	due := m.remoteHeightsURL != config.KnownHeightsURL || time.Since(m.remoteHeightsFetched) > knownHeightsRefresh
+	m.mu.Unlock()
+	if !due {
+		return
+	}
+
+	ranges, err := fetchKnownHeights(ctx, config.KnownHeightsURL)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Retry a failed fetch on the next refresh rather than every cycle.
+	m.remoteHeightsURL = config.KnownHeightsURL
+	m.remoteHeightsFetched = time.Now()
+	if err != nil {
+		m.logf("Warning: %v", err)
+		return
+	}
+	m.remoteHeights = ranges
+}
+
+// updateKnownRange finds the known range blockHeight falls into, and logs
+// and records entering and leaving it. The caller must hold m.mu.
+func (m *monitor) updateKnownRange(blockHeight int64) {
+	var active *KnownHeightRange
+	ranges := append(append([]KnownHeightRange{}, m.config.KnownHeights...), m.remoteHeights...)
+	for i := range ranges {
+		if ranges[i].contains(blockHeight) {
+			active = &ranges[i]
+			break
+		}
+	}
+
+	if m.knownRange != nil && (active == nil || *active != *m.knownRange) {
+		m.logf("Block height %d left known range %s, regular stall detection applies again", blockHeight, m.knownRange)
+		m.recordKnownRange(*m.knownRange, blockHeight, outcomeLeft)
+	}
+	if active != nil && (m.knownRange == nil || *active != *m.knownRange) {
+		if active.Suppress {
+			m.logf("Block height %d is in known range %s, stall detection suppressed", blockHeight, active)
+		} else {
+			m.logf("Block height %d is in known range %s, stall threshold relaxed to %v", blockHeight, active, m.stallTimeoutIn(active))
+		}
+		m.recordKnownRange(*active, blockHeight, outcomeEntered)
+	}
+	m.knownRange = active
+}
+
+func (m *monitor) recordKnownRange(r KnownHeightRange, blockHeight int64, outcome string) {
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventKnownHeight,
+		BlockHeight: blockHeight,
+		Outcome:     outcome,
+		Reason:      r.String(),
+	})
+}
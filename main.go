@@ -3,25 +3,42 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/spf13/viper"
 )
 
-type Config struct {
-	IndexerURL    string        `yaml:"indexerURL"`
-	QueryInterval time.Duration `yaml:"queryInterval"`
-	StallTimeout  time.Duration `yaml:"stallTimeout"`
-	RestartSleep  time.Duration `yaml:"restartSleep"`
-	ContainerName string        `yaml:"containerName"`
-	MetricName    string        `yaml:"metricName"`
+// openEventSinks opens the history file and, when CloudWatch or EventBridge
+// export is configured, the AWS exporter, which is also returned on its own.
+func openEventSinks(config Config) (eventSinks, *awsExporter, error) {
+	history, err := openHistory(config.HistoryFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open history: %w", err)
+	}
+
+	var events eventSinks
+	if history != nil {
+		events = append(events, history)
+	}
+	if config.CloudWatch.Namespace == "" && config.EventBridge.BusName == "" {
+		return events, nil, nil
+	}
+	aws, err := newAWSExporter(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up AWS export: %w", err)
+	}
+	if config.EventBridge.BusName != "" {
+		events = append(events, aws)
+	}
+	return events, aws, nil
 }
 
 type PrometheusResponse struct {
@@ -36,139 +53,161 @@ type PrometheusResponse struct {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "gen-alerts":
+			os.Exit(runGenAlerts(os.Args[2:]))
+		case "gen-dashboard":
+			os.Exit(runGenDashboard(os.Args[2:]))
+		case "self-update":
+			os.Exit(runSelfUpdate(os.Args[2:]))
+		case "version":
+			os.Exit(runVersion())
+		}
+	}
+
+	once := flag.Bool("once", false, "Evaluate every target once, carrying state over in stateFile, and exit")
+	output := flag.String("output", outputText, "Result format of a single run: text, or nagios for a check plugin line and exit code (implies --once)")
+	flag.Parse()
+	if *output != outputText && *output != outputNagios {
+		fatalf(exitUsage, "Unknown output format %q", *output)
+	}
+	if *output == outputNagios {
+		*once = true
+	}
+
 	config, err := LoadConfig("config")
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		if *output == outputNagios {
+			fmt.Printf("NEAR LAKE UNKNOWN - failed to load config: %v\n", err)
+			os.Exit(nagiosUnknown)
+		}
+		fatalf(exitConfig, "Failed to load config: %v", err)
 	}
 
-	log.Printf("Starting near-lake-supervisor")
-	log.Printf("Indexer URL: %s", config.IndexerURL)
+	log.Printf("Starting near-lake-supervisor %s", version)
+	if *once {
+		os.Exit(runOnce(config, *output))
+	}
+	exitOnSignal()
 	log.Printf("Query Interval: %v", config.QueryInterval)
-	log.Printf("Stall Timeout: %v", config.StallTimeout)
-	log.Printf("Container: %s", config.ContainerName)
-
-	var lastBlockHeight int64 = -1
-	var lastProgressTime time.Time = time.Now()
-	var isRestarting bool = false
 
-	ticker := time.NewTicker(config.QueryInterval)
-	defer ticker.Stop()
+	if config.AdminAddr != "" {
+		if err := validateAdmin(config); err != nil {
+			fatalf(exitConfig, "Invalid admin API config: %v", err)
+		}
+	}
+	if config.SelfUpdate.Auto {
+		if err := config.SelfUpdate.validate(); err != nil {
+			fatalf(exitConfig, "Invalid config: %v", err)
+		}
+	}
+	if config.ChatOps.enabled() {
+		if err := validateChatOps(config.ChatOps); err != nil {
+			fatalf(exitConfig, "Invalid chatOps config: %v", err)
+		}
+	}
+	if config.MetricsAddr != "" {
+		if err := serveMetrics(config.MetricsAddr); err != nil {
+			fatalf(exitFatal, "Failed to serve metrics: %v", err)
+		}
+	}
 
-	// Initial query
-	blockHeight, err := queryBlockHeight(config)
+	events, aws, err := openEventSinks(config)
 	if err != nil {
-		log.Printf("Warning: Failed to query block height: %v", err)
-	} else {
-		lastBlockHeight = blockHeight
-		lastProgressTime = time.Now()
-		log.Printf("Initial block height: %d", blockHeight)
+		fatalf(exitFatal, "%v", err)
+	}
+	if aws != nil && config.CloudWatch.Namespace != "" {
+		go aws.exportMetrics()
 	}
 
-	for range ticker.C {
-		if isRestarting {
-			log.Printf("Still in restart cooldown period, skipping query")
-			continue
+	s, err := newSupervisor(config, events)
+	if err != nil {
+		fatalf(exitConfig, "Failed to start supervisor: %v", err)
+	}
+	onExit(s.stopProcesses)
+	if config.AdminAddr != "" {
+		if err := serveAdmin(config, s); err != nil {
+			fatalf(exitFatal, "Failed to start admin API: %v", err)
 		}
-
-		blockHeight, err := queryBlockHeight(config)
-		if err != nil {
-			log.Printf("Error querying block height: %v", err)
-			// Check if we should restart due to query failures
-			if time.Since(lastProgressTime) > config.StallTimeout {
-				log.Printf("Block height query has been failing for %v, attempting restart", config.StallTimeout)
-				if err := restartContainer(config); err != nil {
-					log.Printf("Error restarting container: %v", err)
-				} else {
-					isRestarting = true
-					lastProgressTime = time.Now()
-					go func() {
-						time.Sleep(config.RestartSleep)
-						isRestarting = false
-						log.Printf("Restart cooldown complete, resuming monitoring")
-					}()
-				}
-			}
-			continue
+	}
+	if config.ChatOps.enabled() {
+		if err := startChatOps(config.ChatOps, s); err != nil {
+			fatalf(exitFatal, "Failed to start chatOps: %v", err)
 		}
+	}
+	// Indexer processes start right away; only the first reading waits for
+	// them to come up.
+	s.startProcesses()
+	if config.StartDelay > 0 {
+		log.Printf("Waiting %v before the first evaluation", config.StartDelay)
+		time.Sleep(config.StartDelay)
+	}
+	s.initialize()
 
-		log.Printf("Current block height: %d (last: %d)", blockHeight, lastBlockHeight)
-
-		if blockHeight > lastBlockHeight {
-			// Block height is progressing
-			lastBlockHeight = blockHeight
-			lastProgressTime = time.Now()
-			log.Printf("Block height progressing: %d", blockHeight)
-		} else if blockHeight == lastBlockHeight {
-			// Block height is stalled
-			stallDuration := time.Since(lastProgressTime)
-			log.Printf("Block height stalled at %d for %v", blockHeight, stallDuration)
-
-			if stallDuration > config.StallTimeout {
-				log.Printf("Block height has been stalled for %v (threshold: %v), restarting container", stallDuration, config.StallTimeout)
-				if err := restartContainer(config); err != nil {
-					log.Printf("Error restarting container: %v", err)
-				} else {
-					isRestarting = true
-					lastProgressTime = time.Now()
-					go func() {
-						time.Sleep(config.RestartSleep)
-						isRestarting = false
-						log.Printf("Restart cooldown complete, resuming monitoring")
-					}()
-				}
-			}
-		} else {
-			// Block height decreased (shouldn't happen, but handle it)
-			log.Printf("Warning: Block height decreased from %d to %d", lastBlockHeight, blockHeight)
-			lastBlockHeight = blockHeight
-			lastProgressTime = time.Now()
-		}
+	go s.watchConfig("config")
+	if config.SelfUpdate.Auto {
+		go autoUpdate(config.SelfUpdate)
 	}
+	s.run()
 }
 
-func queryBlockHeight(config Config) (int64, error) {
+func queryBlockHeight(ctx context.Context, config TargetConfig) (int64, error) {
 	// Try Prometheus API first (JSON format)
+	start := time.Now()
+	height, err := queryBlockHeightJSON(ctx, config)
+	observeQuery(config.Name, sourcePrometheus, pathJSON, start, err)
+	if err == nil {
+		return height, nil
+	}
+
+	// Fallback to metrics endpoint (text format)
+	start = time.Now()
+	height, err = queryBlockHeightText(ctx, config)
+	observeQuery(config.Name, sourcePrometheus, pathText, start, err)
+	return height, err
+}
+
+func queryBlockHeightJSON(ctx context.Context, config TargetConfig) (int64, error) {
 	url := fmt.Sprintf("%s/api/v1/query?query=%s", config.IndexerURL, config.MetricName)
-	resp, err := http.Get(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
-		// Fallback to metrics endpoint (text format)
-		return queryBlockHeightText(config)
+		return 0, fmt.Errorf("failed to query: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		// Fallback to metrics endpoint
-		return queryBlockHeightText(config)
+		return 0, fmt.Errorf("query API returned status %d", resp.StatusCode)
 	}
 
 	var promResp PrometheusResponse
 	if err := json.NewDecoder(resp.Body).Decode(&promResp); err != nil {
-		// Fallback to metrics endpoint
-		return queryBlockHeightText(config)
+		return 0, fmt.Errorf("failed to decode query response: %w", err)
 	}
 
 	if promResp.Status != "success" || len(promResp.Data.Result) == 0 {
-		// Fallback to metrics endpoint
-		return queryBlockHeightText(config)
+		return 0, fmt.Errorf("query for %s returned no result", config.MetricName)
 	}
 
 	// Extract value from Prometheus response
 	valueStr, ok := promResp.Data.Result[0].Value[1].(string)
 	if !ok {
-		return queryBlockHeightText(config)
+		return 0, fmt.Errorf("query for %s returned a non-string value", config.MetricName)
 	}
 
 	value, err := strconv.ParseFloat(valueStr, 64)
 	if err != nil {
-		return queryBlockHeightText(config)
+		return 0, err
 	}
 
 	return int64(value), nil
 }
 
-func queryBlockHeightText(config Config) (int64, error) {
+func queryBlockHeightText(ctx context.Context, config TargetConfig) (int64, error) {
 	url := fmt.Sprintf("%s/metrics", config.IndexerURL)
-	resp, err := http.Get(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return 0, fmt.Errorf("failed to fetch metrics: %w", err)
 	}
@@ -201,67 +240,51 @@ func queryBlockHeightText(config Config) (int64, error) {
 	return 0, fmt.Errorf("metric %s not found in response", config.MetricName)
 }
 
-func restartContainer(config Config) error {
-	if config.ContainerName == "" {
-		return fmt.Errorf("container name not specified")
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
+	return http.DefaultClient.Do(req)
+}
 
-	log.Printf("Restarting container: %s", config.ContainerName)
+func restartContainer(ctx context.Context, container string) error {
+	if container == "" {
+		return fmt.Errorf("container name not specified")
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	tracef(ctx, "Restarting container: %s", container)
+	return docker(ctx, "restart", container)
+}
 
-	cmd := exec.CommandContext(ctx, "docker", "restart", config.ContainerName)
+// docker runs a docker CLI command. An error wraps ctx.Err() when the command
+// was cut short by ctx.
+func docker(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("docker %s: %w", args[0], ctx.Err())
+	}
 	if err != nil {
-		return fmt.Errorf("docker restart failed: %w, output: %s", err, string(output))
+		return commandError("docker "+args[0], err, output)
 	}
-	log.Printf("docker restart output: %s", string(output))
+	tracef(ctx, "docker %s output: %s", args[0], string(output))
 	return nil
 }
 
-func LoadConfig(path string) (config Config, err error) {
-	viper.AddConfigPath(path)
-	viper.SetConfigName("local")
-	viper.SetConfigType("yaml")
-
-	// Set defaults
-	viper.SetDefault("indexerURL", "http://indexer:3030")
-	viper.SetDefault("queryInterval", "30s")
-	viper.SetDefault("stallTimeout", "5m")
-	viper.SetDefault("restartSleep", "900s")
-	viper.SetDefault("metricName", "near_indexer_streaming_current_block_height")
-	viper.SetDefault("containerName", "near-lake-indexer")
-
-	viper.AutomaticEnv()
-
-	err = viper.ReadInConfig()
-	if err != nil {
-		// If config file doesn't exist, use defaults
-		log.Printf("Config file not found, using defaults: %v", err)
+// dockerOutput runs a docker CLI command and returns its trimmed output.
+func dockerOutput(ctx context.Context, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, "docker", args...).Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("docker %s: %w", args[0], ctx.Err())
 	}
-
-	err = viper.Unmarshal(&config)
 	if err != nil {
-		return
-	}
-
-	// Parse duration strings
-	if queryIntervalStr := viper.GetString("queryInterval"); queryIntervalStr != "" {
-		if d, err := time.ParseDuration(queryIntervalStr); err == nil {
-			config.QueryInterval = d
-		}
-	}
-	if stallTimeoutStr := viper.GetString("stallTimeout"); stallTimeoutStr != "" {
-		if d, err := time.ParseDuration(stallTimeoutStr); err == nil {
-			config.StallTimeout = d
+		var stderr []byte
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr = exitErr.Stderr
 		}
+		return "", commandError("docker "+args[0], err, stderr)
 	}
-	if restartSleepStr := viper.GetString("restartSleep"); restartSleepStr != "" {
-		if d, err := time.ParseDuration(restartSleepStr); err == nil {
-			config.RestartSleep = d
-		}
-	}
-
-	return
+	return strings.TrimSpace(string(output)), nil
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Restart reasons and outcomes used as label values.
+const (
+	reasonStall        = "stall"
+	reasonQueryFailure = "query_failure"
+	reasonManual       = "manual"
+	reasonProbeFailure = "probe_failure"
+	reasonShardStall   = "shard_stall"
+	// reasonUploadFailure is a restart for S3 uploads that keep failing.
+	reasonUploadFailure = "upload_failure"
+	// reasonImageUpdate recreates the container from a new image.
+	reasonImageUpdate = "image_update"
+	// reasonProcessExit starts an indexer process that exited on its own.
+	reasonProcessExit = "process_exit"
+	// reasonPeerLag is a restart for falling behind the redundant peer.
+	reasonPeerLag = "peer_lag"
+	// reasonRestartTimeout is the kill and start escalation of a restart
+	// that ran out of time.
+	reasonRestartTimeout = "restart_timeout"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeTimeout = "timeout"
+)
+
+// Query paths used as label values. The prometheus source tries the query
+// API before the text exposition format, and the shard heights are read from
+// the text format too, as are the upload counters. Other sources have a
+// single path.
+const (
+	pathJSON    = "json"
+	pathText    = "text"
+	pathShards  = "shards"
+	pathUploads = "uploads"
+	pathDefault = "default"
+)
+
+// durationBuckets spans 30s to roughly 8.5h, which covers everything from a
+// short hiccup to a stall that outlived several restart cooldowns.
+var durationBuckets = prometheus.ExponentialBuckets(30, 2, 10)
+
+var (
+	blockHeightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_block_height",
+		Help: "Last block height observed for the target.",
+	}, []string{"target"})
+
+	stallSecondsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_stall_seconds",
+		Help: "Seconds since the target's block height last progressed.",
+	}, []string{"target"})
+
+	blockTimestampGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_block_timestamp_seconds",
+		Help: "Last block timestamp observed for a target in timestamp mode.",
+	}, []string{"target"})
+
+	stallThresholdGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_stall_threshold_seconds",
+		Help: "Stall threshold currently in force for the target, +Inf while a known height range suppresses stall detection.",
+	}, []string{"target"})
+
+	resyncingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_resyncing",
+		Help: "1 while the target is catching up after a resync, 0 otherwise.",
+	}, []string{"target"})
+
+	shardBlockHeightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_shard_block_height",
+		Help: "Last block height observed for each shard of the target.",
+	}, []string{"target", "shard"})
+
+	shardStallSecondsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_shard_stall_seconds",
+		Help: "Seconds since the shard's block height last progressed.",
+	}, []string{"target", "shard"})
+
+	probeUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_probe_up",
+		Help: "1 if the target's liveness probe succeeded in the last cycle, 0 otherwise.",
+	}, []string{"target"})
+
+	runtimeUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_runtime_up",
+		Help: "0 while the container runtime is unreachable and restarts cannot remediate, 1 after a restart went through.",
+	}, []string{"target"})
+
+	uploadsUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_uploads_up",
+		Help: "1 if the target's S3 uploads succeeded in the last cycle, 0 if they are failing.",
+	}, []string{"target"})
+
+	uploadErrorRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_upload_error_rate",
+		Help: "Failing fraction of the target's uploads in the last cycle, or upload errors per second without a put metric.",
+	}, []string{"target"})
+
+	restartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "near_lake_supervisor_restarts_total",
+		Help: "Restart attempts by reason and outcome.",
+	}, []string{"target", "reason", "outcome"})
+
+	stallDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "near_lake_supervisor_stall_duration_seconds",
+		Help:    "Duration of stalls, observed when progress resumes or a restart is triggered.",
+		Buckets: durationBuckets,
+	}, []string{"target"})
+
+	recoveryDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "near_lake_supervisor_recovery_duration_seconds",
+		Help:    "Time from a successful restart until block height progressed again.",
+		Buckets: durationBuckets,
+	}, []string{"target"})
+
+	sourceQueryDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "near_lake_supervisor_source_query_duration_seconds",
+		Help: "Latency of block height queries, by source and path, whether they succeeded or not.",
+	}, []string{"target", "source", "path"})
+
+	sourceQueryErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "near_lake_supervisor_source_query_errors_total",
+		Help: "Failed block height queries by source and path.",
+	}, []string{"target", "source", "path"})
+
+	blocksBehindGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_blocks_behind",
+		Help: "Blocks the target trails the reference head by (only with referenceRPC).",
+	}, []string{"target"})
+
+	consumerLagGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_consumer_lag_blocks",
+		Help: "Blocks a downstream consumer trails the target's block height by.",
+	}, []string{"target", "consumer"})
+
+	consumerUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_consumer_up",
+		Help: "1 if the downstream consumer kept up with the target in the last cycle, 0 if it lags beyond maxLag or cannot be read.",
+	}, []string{"target", "consumer"})
+
+	peerLagGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "near_lake_supervisor_peer_lag_blocks",
+		Help: "Blocks the target trails its redundant peer by (only with peer).",
+	}, []string{"target", "peer"})
+
+	evaluationsSkippedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "near_lake_supervisor_evaluations_skipped_total",
+		Help: "Evaluations skipped because the previous one was still queued or running.",
+	}, []string{"target"})
+)
+
+// observeQuery records the latency and outcome of a query that began at
+// start. The error counter is created at zero so that its rate is defined
+// before the first failure.
+func observeQuery(target, source, path string, start time.Time, err error) {
+	sourceQueryDurationSeconds.WithLabelValues(target, source, path).Observe(time.Since(start).Seconds())
+	failures := sourceQueryErrorsTotal.WithLabelValues(target, source, path)
+	if err != nil {
+		failures.Inc()
+	}
+}
+
+// serveMetrics listens on addr and serves the metrics in the background. A
+// server that stops later exits the process, since scraping would silently
+// stop working otherwise.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		err := http.Serve(listener, mux)
+		fatalf(exitFatal, "Metrics server stopped: %v", err)
+	}()
+	return nil
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitor tracks the block height of one target and restarts its container
+// when the height stops progressing.
+type monitor struct {
+	target string
+	events eventSinks
+
+	// The fields up to mu are not guarded by it: they are set before the
+	// monitor runs, guard themselves or are accessed atomically.
+	//
+	// process runs the indexer when it is not in a container.
+	process *childProcess
+	// scheduled is set while an evaluation of the monitor is queued for or
+	// running on a worker.
+	scheduled atomic.Bool
+	// published is the latest height reading, for the targets that have this
+	// one as their peer, which they find through lookup.
+	published atomic.Pointer[heightReading]
+	lookup    func(name string) *monitor
+
+	// mu guards the fields below, which the admin API and config reloads read
+	// and change while the monitor is running.
+	mu     sync.Mutex
+	config TargetConfig
+	source heightSource
+	// consumerSources read the positions of the downstream consumers, whose
+	// lag is tracked in consumers by name.
+	consumerSources []consumerSource
+	consumers       map[string]*consumerState
+
+	lastBlockHeight  int64
+	lastProgressTime time.Time
+	// lastError is the error of the last query, empty once one succeeds.
+	lastError string
+	// probeFailingSince is when the liveness probe started failing, zero
+	// while it succeeds.
+	probeFailingSince time.Time
+	probeError        string
+	// uploads is the previous reading of the upload counters, and
+	// uploadsFailingSince when uploads started failing. uploadsNotified is
+	// set once the failure has been recorded as an event.
+	uploads             *uploadCounters
+	uploadsFailingSince time.Time
+	uploadsError        string
+	uploadsNotified     bool
+	// pendingImage is the ID of a pulled image update that waits for the
+	// maintenance window. imageCheck tracks the check running in the
+	// background, if imageChecking.
+	pendingImage   string
+	imageCheckedAt time.Time
+	imageChecking  bool
+	imageCheck     sync.WaitGroup
+	// shards tracks each shard separately when ShardMetricName is set, as a
+	// single lagging shard does not hold back the aggregate height.
+	shards map[string]*shardState
+	// stuckShard names the shard a restart in progress is for.
+	stuckShard string
+	// knownRange is the known height range the block height is in, if any.
+	// remoteHeights holds the ranges of the last successful fetch, and
+	// remoteHeightsURL and remoteHeightsFetched the URL and time of the last
+	// attempt.
+	knownRange           *KnownHeightRange
+	remoteHeights        []KnownHeightRange
+	remoteHeightsURL     string
+	remoteHeightsFetched time.Time
+
+	// stalled is set once a stall has been observed and cleared when it ends,
+	// so that each stall is recorded in the duration histogram exactly once.
+	stalled bool
+	// restartedAt is the time of the last successful restart that has not yet
+	// been followed by progress, and restartedID its restart ID.
+	restartedAt   time.Time
+	restartedID   string
+	cooldownUntil time.Time
+	pausedUntil   time.Time
+	// resyncing is set while the target catches up after its block height
+	// dropped sharply, e.g. because the data dir was wiped.
+	resyncing         bool
+	resyncStart       time.Time
+	resyncFromHeight  int64
+	resyncUntilHeight int64
+	// referenceHeight is the reference head read in the last cycle that
+	// queried the block height successfully, and blocksBehind how far the
+	// target trailed it, both -1 when unknown.
+	referenceHeight int64
+	blocksBehind    int64
+	// peerLaggingSince is when the target started to trail its peer by more
+	// than maxLag, zero while it keeps up, and peerLag by how much, -1 when
+	// unknown. peerNotified is set once that has been recorded as an event.
+	peerLaggingSince time.Time
+	peerLag          int64
+	peerNotified     bool
+
+	// runtimeUnreachableSince is when restarts started failing because the
+	// container runtime cannot be reached, zero while it can. Restarts are
+	// held back until runtimeRetryAt, with runtimeBackoff doubling after every
+	// failed attempt.
+	runtimeUnreachableSince time.Time
+	runtimeRetryAt          time.Time
+	runtimeBackoff          time.Duration
+	runtimeError            string
+
+	// cycleID and restartID identify the evaluation cycle and the restart in
+	// progress, for correlating log lines and events.
+	cycleID   string
+	restartID string
+	// restarting is set while a restart runs with mu released, so that
+	// neither another restart nor an evaluation starts meanwhile.
+	restarting bool
+
+	// stopped is set when the target is removed from the config, so that an
+	// evaluation already scheduled does not act on it.
+	stopped bool
+}
+
+func newMonitor(config TargetConfig, events eventSinks) (*monitor, error) {
+	source, err := newHeightSource(config)
+	if err != nil {
+		return nil, fmt.Errorf("target %q: %w", config.Name, err)
+	}
+	consumerSources, err := newConsumerSources(config)
+	if err != nil {
+		closeSource(source)
+		return nil, fmt.Errorf("target %q: %w", config.Name, err)
+	}
+	m := &monitor{
+		config:           config,
+		source:           source,
+		consumerSources:  consumerSources,
+		consumers:        make(map[string]*consumerState),
+		target:           config.Name,
+		events:           events,
+		lastBlockHeight:  -1,
+		lastProgressTime: time.Now(),
+		referenceHeight:  -1,
+		blocksBehind:     -1,
+		peerLag:          -1,
+		shards:           make(map[string]*shardState),
+	}
+	if config.Process.enabled() {
+		m.process = newChildProcess(config.Name, config.Process, m.processExited)
+	}
+	return m, nil
+}
+
+// logf logs with the target and the current cycle and restart IDs. The
+// caller must hold m.mu.
+func (m *monitor) logf(format string, args ...interface{}) {
+	log.Print(m.trace().prefix() + fmt.Sprintf(format, args...))
+}
+
+// trace returns the current cycle and restart IDs. The caller must hold m.mu.
+func (m *monitor) trace() trace {
+	return trace{target: m.target, cycle: m.cycleID, restart: m.restartID}
+}
+
+// record records an event with the current cycle and restart IDs. The
+// caller must hold m.mu.
+func (m *monitor) record(event historyEvent) {
+	if event.Cycle == "" {
+		event.Cycle = m.cycleID
+	}
+	if event.Restart == "" {
+		event.Restart = m.restartID
+	}
+	if event.BlocksBehind == nil && m.blocksBehind >= 0 {
+		blocksBehind := m.blocksBehind
+		event.BlocksBehind = &blocksBehind
+	}
+	m.events.record(event)
+}
+
+// beginCycle assigns a new cycle ID and returns a context carrying it, for
+// the queries of the cycle, which have to complete within evaluationTimeout.
+func (m *monitor) beginCycle() (context.Context, context.CancelFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cycleID = newTraceID()
+	return context.WithTimeout(withTrace(context.Background(), m.trace()), m.config.EvaluationTimeout)
+}
+
+func (m *monitor) endCycle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cycleID = ""
+}
+
+// withoutCycle runs f with the cycle ID cleared, for work that is not part
+// of a cycle that may be in progress. The caller must hold m.mu.
+func (m *monitor) withoutCycle(f func()) {
+	cycle := m.cycleID
+	m.cycleID = ""
+	defer func() { m.cycleID = cycle }()
+	f()
+}
+
+// startProcess starts the indexer of a target in process mode, ahead of the
+// initial reading and the startDelay before it.
+func (m *monitor) startProcess() {
+	if m.process == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logf("Process: %s", strings.Join(m.config.Process.Command, " "))
+	if err := m.process.start(); err != nil {
+		m.logf("Error starting indexer process: %v", err)
+	}
+}
+
+// initialize takes the initial block height reading.
+func (m *monitor) initialize() {
+	m.mu.Lock()
+	config, source := m.config, m.source
+	if config.SourceType == sourcePrometheus {
+		m.logf("Indexer URL: %s", config.IndexerURL)
+	} else {
+		m.logf("Source: %s", config.SourceType)
+	}
+	if config.FallbackSourceType != "" {
+		m.logf("Fallback Source: %s", config.FallbackSourceType)
+	}
+	if config.MetricMode == metricModeTimestamp {
+		m.logf("Max Block Age: %v", config.MaxBlockAge)
+	} else if config.StallBlocks > 0 {
+		m.logf("Stall Timeout: %v (%d blocks of %v)", config.StallTimeout, config.StallBlocks, config.ExpectedBlockTime)
+	} else {
+		m.logf("Stall Timeout: %v", config.StallTimeout)
+	}
+	if m.process == nil {
+		m.logf("Container: %s", config.ContainerName)
+	}
+	if len(config.Dependents) > 0 {
+		m.logf("Restart Group: %s", strings.Join(restartOrder(config), ", "))
+	}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.EvaluationTimeout)
+	defer cancel()
+	blockHeight, err := source.queryHeight(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.logf("Warning: Failed to query block height: %v", err)
+		m.lastError = err.Error()
+		return
+	}
+	m.lastError = ""
+	m.lastBlockHeight = blockHeight
+	m.lastProgressTime = time.Now()
+	// Exported in both modes from the start, for the dashboard's target list.
+	stallSecondsGauge.WithLabelValues(m.target).Set(0)
+	m.publishStallThreshold()
+	if config.MetricMode == metricModeTimestamp {
+		m.lastProgressTime = time.Unix(blockHeight, 0)
+		blockTimestampGauge.WithLabelValues(m.target).Set(float64(blockHeight))
+		m.logf("Initial block timestamp: %s", m.lastProgressTime.UTC().Format(time.RFC3339))
+		return
+	}
+	blockHeightGauge.WithLabelValues(m.target).Set(float64(blockHeight))
+	m.publishHeight(blockHeight)
+	m.logf("Initial block height: %d", blockHeight)
+}
+
+// setConfig applies a reloaded target config. Progress state is kept, so a
+// changed threshold takes effect against the current stall.
+func (m *monitor) setConfig(config TargetConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if reflect.DeepEqual(config, m.config) {
+		return nil
+	}
+	if config.Process.enabled() != (m.process != nil) {
+		return fmt.Errorf("switching between container and process mode requires a restart")
+	}
+	source, err := newHeightSource(config)
+	if err != nil {
+		return err
+	}
+	consumerSources, err := newConsumerSources(config)
+	if err != nil {
+		closeSource(source)
+		return err
+	}
+	if m.process != nil {
+		m.process.setConfig(config.Process)
+	}
+	closeSource(m.source)
+	closeConsumerSources(m.consumerSources)
+	m.config = config
+	m.source = source
+	m.consumerSources = consumerSources
+	m.pruneConsumers()
+	return nil
+}
+
+func (m *monitor) evaluate() {
+	ctx, cancel := m.beginCycle()
+	defer cancel()
+	defer m.endCycle()
+	source, config, ok := m.shouldQuery()
+	if !ok {
+		return
+	}
+	consumerSources := m.consumerSourceList()
+	peerReading := m.peerReading(config)
+
+	blockHeight, err := source.queryHeight(ctx)
+	var probeErr error
+	if config.Probe.Type != "" {
+		probeErr = config.Probe.run(ctx)
+	}
+	var shardHeights map[string]int64
+	var shardErr error
+	if config.ShardMetricName != "" {
+		shardHeights, shardErr = queryShardHeights(ctx, config)
+	}
+	var uploads uploadCounters
+	var uploadsErr error
+	if config.Uploads.enabled() {
+		uploads, uploadsErr = queryUploadCounters(ctx, config)
+	}
+	var referenceHeight int64
+	var referenceErr error
+	if config.ReferenceRPC != "" && config.MetricMode == metricModeHeight {
+		referenceHeight, referenceErr = queryReferenceHeight(ctx, config.ReferenceRPC)
+	}
+	var consumerReadings []consumerReading
+	if config.MetricMode == metricModeHeight {
+		consumerReadings = queryConsumers(ctx, consumerSources)
+	}
+	m.refreshKnownHeights(ctx, config)
+	m.refreshImage(config)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.applyImageUpdate() {
+		return
+	}
+	if err == nil && m.config.MetricMode == metricModeHeight {
+		m.updateKnownRange(blockHeight)
+	}
+	if m.recordProbe(probeErr) {
+		m.logf("Probe has been failing for more than %v, restarting container", m.config.Probe.FailureTimeout)
+		m.restart(reasonProbeFailure)
+		return
+	}
+	if err != nil {
+		m.logf("Error querying block height: %v", err)
+		m.lastError = err.Error()
+		m.markStalled()
+		// Check if we should restart due to query failures
+		if stallTimeout := m.stallTimeout(); time.Since(m.lastProgressTime) > stallTimeout {
+			m.logf("Block height query has been failing for %v (%s), attempting restart", stallTimeout, m.diagnosis())
+			m.restart(reasonQueryFailure)
+		}
+		return
+	}
+
+	m.lastError = ""
+	if config.MetricMode == metricModeHeight {
+		m.updateBlocksBehind(config, blockHeight, referenceHeight, referenceErr)
+		m.checkConsumers(consumerSources, consumerReadings, blockHeight)
+		m.publishHeight(blockHeight)
+		if m.checkPeer(peerReading, blockHeight) {
+			return
+		}
+	}
+	if m.checkUploads(uploads, uploadsErr, blockHeight > m.lastBlockHeight) {
+		return
+	}
+	if m.config.MetricMode == metricModeTimestamp {
+		if !m.evaluateTimestamp(blockHeight) {
+			m.checkShards(shardHeights, shardErr)
+		}
+		return
+	}
+	m.logf("Current block height: %d (last: %d)", blockHeight, m.lastBlockHeight)
+	blockHeightGauge.WithLabelValues(m.target).Set(float64(blockHeight))
+
+	if blockHeight > m.lastBlockHeight {
+		// Block height is progressing
+		rate := m.progressRate(blockHeight)
+		resyncing := m.resyncing
+		if !resyncing {
+			m.checkCatchUp(m.config, blockHeight, rate)
+		}
+		m.progressed(blockHeight)
+		m.logf("Block height progressing: %d", blockHeight)
+		if resyncing {
+			m.checkResync(m.config, blockHeight, rate)
+		}
+	} else if blockHeight == m.lastBlockHeight {
+		// Block height is stalled
+		stallDuration := time.Since(m.lastProgressTime)
+		m.logf("Block height stalled at %d for %v", blockHeight, stallDuration)
+		m.markStalled()
+
+		if stallTimeout := m.stallTimeout(); stallDuration > stallTimeout {
+			m.logf("Block height has been stalled for %v (threshold: %v), restarting container", stallDuration, stallTimeout)
+			m.restart(reasonStall)
+			return
+		}
+	} else {
+		// Block height decreased. A large drop means the node is resyncing
+		// from an old height, which gets a relaxed stall policy.
+		regression := m.lastBlockHeight - blockHeight
+		if m.config.ResyncMinRegression > 0 && regression >= m.config.ResyncMinRegression {
+			if !m.resyncing {
+				m.startResync(blockHeight)
+			}
+		} else {
+			m.logf("Warning: Block height decreased from %d to %d", m.lastBlockHeight, blockHeight)
+		}
+		m.endStall(outcomeResumed)
+		m.lastBlockHeight = blockHeight
+		m.lastProgressTime = time.Now()
+	}
+
+	m.checkShards(shardHeights, shardErr)
+}
+
+// checkShards restarts the container when a shard is stuck while the target
+// as a whole progresses. The caller must hold m.mu.
+func (m *monitor) checkShards(heights map[string]int64, err error) {
+	if shard, stall := m.updateShards(heights, err); shard != "" {
+		m.logf("Shard %s has been stalled at %d for %v (threshold: %v) while the block height progresses, restarting container", shard, m.shards[shard].height, stall.Round(time.Second), m.stallTimeout())
+		m.stuckShard = shard
+		m.restart(reasonShardStall)
+		m.stuckShard = ""
+	}
+}
+
+// progressed records that the block height advanced to blockHeight.
+func (m *monitor) progressed(blockHeight int64) {
+	m.endStall(outcomeResumed)
+	if !m.restartedAt.IsZero() {
+		recovery := time.Since(m.restartedAt)
+		recoveryDurationSeconds.WithLabelValues(m.target).Observe(recovery.Seconds())
+		m.record(historyEvent{
+			Target:      m.target,
+			Type:        eventRecovery,
+			BlockHeight: blockHeight,
+			Duration:    recovery,
+			Restart:     m.restartedID,
+		})
+		m.restartedAt = time.Time{}
+		m.restartedID = ""
+	}
+	m.lastBlockHeight = blockHeight
+	m.lastProgressTime = time.Now()
+}
+
+func (m *monitor) markStalled() {
+	m.stalled = true
+	stallSecondsGauge.WithLabelValues(m.target).Set(time.Since(m.lastProgressTime).Seconds())
+	m.publishStallThreshold()
+}
+
+// endStall records the duration of the current stall, if any, and how it
+// ended.
+func (m *monitor) endStall(outcome string) {
+	if m.stalled {
+		stall := time.Since(m.lastProgressTime)
+		stallDurationSeconds.WithLabelValues(m.target).Observe(stall.Seconds())
+		m.record(historyEvent{
+			Target:      m.target,
+			Type:        eventStall,
+			BlockHeight: m.lastBlockHeight,
+			Outcome:     outcome,
+			Duration:    stall,
+		})
+		m.stalled = false
+	}
+	stallSecondsGauge.WithLabelValues(m.target).Set(0)
+	m.publishStallThreshold()
+}
+
+// restart restarts the container's restart group and starts the cooldown
+// period. The caller must hold m.mu.
+func (m *monitor) restart(reason string) error {
+	return m.restartWith(reason, m.restartGroup)
+}
+
+// errRestartInProgress refuses a restart while another one of the same target
+// is running.
+var errRestartInProgress = errors.New("a restart is already in progress")
+
+// errTargetRemoved ends a restart of a target that was removed from the
+// config while it ran.
+var errTargetRemoved = errors.New("target removed from the config")
+
+// restartWith restarts the container with action, given the config at the
+// start of the restart. A restart that does not complete within
+// restartTimeout is recorded with the timeout outcome and escalated. Each
+// restart gets its own ID. The caller must hold m.mu, which is released
+// while action and the escalation run, so that the status stays available
+// for as long as they take.
+func (m *monitor) restartWith(reason string, action func(context.Context, TargetConfig) error) error {
+	if m.restarting {
+		return fmt.Errorf("not restarting: %w", errRestartInProgress)
+	}
+	// A restart requested through the admin API is attempted regardless.
+	if reason != reasonManual && m.runtimeBackingOff() {
+		return fmt.Errorf("not restarting: %w", errRuntimeUnreachable)
+	}
+	m.restartID = newTraceID()
+	m.restarting = true
+	defer func() {
+		m.restartID = ""
+		m.restarting = false
+	}()
+	config := m.config
+	traced := withTrace(context.Background(), m.trace())
+
+	event := historyEvent{
+		Target:      m.target,
+		Type:        eventRestart,
+		BlockHeight: m.lastBlockHeight,
+		Reason:      reason,
+		Duration:    time.Since(m.lastProgressTime),
+		Probe:       m.probeResult(),
+		Shard:       m.stuckShard,
+	}
+	var err error
+	m.unlocked(func() {
+		ctx, cancel := context.WithTimeout(traced, config.RestartTimeout)
+		defer cancel()
+		err = action(ctx, config)
+	})
+	if m.stopped {
+		return m.restartAbandoned()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		m.logf("Restart did not complete within %v: %v", config.RestartTimeout, err)
+		restartsTotal.WithLabelValues(m.target, reason, outcomeTimeout).Inc()
+		event.Outcome = outcomeTimeout
+		event.Error = err.Error()
+		m.record(event)
+		if config.RestartTimeoutEscalation != escalationKill {
+			return err
+		}
+
+		reason = reasonRestartTimeout
+		event.Reason = reason
+		event.Outcome = ""
+		event.Error = ""
+		if m.process != nil {
+			m.logf("Escalating: killing and starting the indexer process")
+		} else {
+			m.logf("Escalating: killing and starting container %s", config.ContainerName)
+		}
+		m.unlocked(func() {
+			if m.process != nil {
+				err = m.process.killAndStart(traced)
+			} else {
+				err = killAndStart(traced, config)
+			}
+		})
+		if m.stopped {
+			return m.restartAbandoned()
+		}
+	}
+	if err != nil {
+		m.logf("Error restarting container: %v", err)
+		restartsTotal.WithLabelValues(m.target, reason, outcomeFailure).Inc()
+		event.Outcome = outcomeFailure
+		event.Error = err.Error()
+		m.record(event)
+		if errors.Is(err, errRuntimeUnreachable) {
+			m.runtimeUnreachable(err)
+		}
+		return err
+	}
+	restartsTotal.WithLabelValues(m.target, reason, outcomeSuccess).Inc()
+	event.Outcome = outcomeSuccess
+	m.record(event)
+	m.runtimeReachable()
+
+	m.endStall(outcomeRestarted)
+	m.resetShards()
+	m.restartedAt = time.Now()
+	m.restartedID = m.restartID
+	m.lastProgressTime = time.Now()
+	m.cooldownUntil = time.Now().Add(m.config.RestartSleep)
+	return nil
+}
+
+// restartAbandoned leaves the outcome of a restart unrecorded when the target
+// was removed from the config while it ran, as stopMonitor has already
+// dropped its metrics. The caller must hold m.mu.
+func (m *monitor) restartAbandoned() error {
+	m.logf("Target removed from the config during the restart, not recording its outcome")
+	return errTargetRemoved
+}
+
+// unlocked runs f with m.mu released, keeping the cycle ID of the caller.
+// The caller must hold m.mu and must not rely on the rest of the monitor's
+// state staying the same across f.
+func (m *monitor) unlocked(f func()) {
+	cycle := m.cycleID
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.cycleID = cycle
+	}()
+	f()
+}
+
+// shouldQuery reports whether the monitor is neither paused nor cooling down
+// after a restart, and resets the stall clock when either period has ended.
+// It also returns the source to query and the config to query it with.
+func (m *monitor) shouldQuery() (heightSource, TargetConfig, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return m.source, m.config, false
+	}
+	if m.restarting {
+		m.logf("Restart in progress, skipping query")
+		return m.source, m.config, false
+	}
+	now := time.Now()
+	if now.Before(m.pausedUntil) {
+		m.logf("Monitoring paused until %s, skipping query", m.pausedUntil.Format(time.RFC3339))
+		return m.source, m.config, false
+	}
+	if !m.pausedUntil.IsZero() {
+		m.pausedUntil = time.Time{}
+		m.lastProgressTime = now
+		m.resetShards()
+		m.logf("Pause expired, resuming monitoring")
+	}
+	if now.Before(m.cooldownUntil) {
+		m.logf("Still in restart cooldown period, skipping query")
+		return m.source, m.config, false
+	}
+	if !m.cooldownUntil.IsZero() {
+		m.cooldownUntil = time.Time{}
+		m.logf("Restart cooldown complete, resuming monitoring")
+		m.probeFailingSince = time.Time{}
+	}
+	return m.source, m.config, true
+}
+
+// consumerSourceList returns the consumers to read in this cycle.
+func (m *monitor) consumerSourceList() []consumerSource {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.consumerSources
+}
+
+// stop marks the monitor stopped and closes its sources, and returns its
+// config as of then. Its process is left running for stopProcess.
+func (m *monitor) stop() TargetConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	closeSource(m.source)
+	closeConsumerSources(m.consumerSources)
+	return m.config
+}
+
+// stopProcess stops the indexer process of a target in process mode, which
+// may take up to its stopTimeout.
+func (m *monitor) stopProcess() {
+	if m.process == nil {
+		return
+	}
+	if err := m.process.stop(context.Background()); err != nil {
+		log.Printf("%sError stopping indexer process: %v", trace{target: m.target}.prefix(), err)
+	}
+}
+
+// pause suspends stall detection and restarts for d.
+func (m *monitor) pause(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pausedUntil = time.Now().Add(d)
+	m.endStall(outcomePaused)
+	m.logf("Monitoring paused for %v", d)
+}
+
+// resume ends a pause early. The stall clock starts over so that time spent
+// paused does not count towards the stall timeout.
+func (m *monitor) resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pausedUntil.IsZero() {
+		return
+	}
+	m.pausedUntil = time.Time{}
+	m.lastProgressTime = time.Now()
+	m.logf("Monitoring resumed")
+}
+
+// forceRestart restarts the container regardless of the block height, as
+// requested through by.
+func (m *monitor) forceRestart(by string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	m.withoutCycle(func() {
+		m.logf("Restart requested through %s", by)
+		err = m.restart(reasonManual)
+	})
+	return err
+}
+
+// monitorStatus is a point-in-time view of a monitor, as served by the admin
+// API.
+type monitorStatus struct {
+	Target           string        `json:"target"`
+	BlockHeight      int64         `json:"blockHeight"`
+	LastProgressTime time.Time     `json:"lastProgressTime"`
+	StallSeconds     float64       `json:"stallSeconds"`
+	PausedUntil      *time.Time    `json:"pausedUntil,omitempty"`
+	CooldownUntil    *time.Time    `json:"cooldownUntil,omitempty"`
+	Probe            string        `json:"probe,omitempty"`
+	Shards           []shardStatus `json:"shards,omitempty"`
+	KnownRange       string        `json:"knownRange,omitempty"`
+	Runtime          string        `json:"runtime,omitempty"`
+	BlocksBehind     *int64        `json:"blocksBehind,omitempty"`
+	Peer             string        `json:"peer,omitempty"`
+	PeerLag          *int64        `json:"peerLag,omitempty"`
+	// Consumers are the downstream consumers by name.
+	Consumers map[string]consumerState `json:"consumers,omitempty"`
+}
+
+func (m *monitor) status() monitorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := monitorStatus{
+		Target:           m.target,
+		BlockHeight:      m.lastBlockHeight,
+		LastProgressTime: m.lastProgressTime,
+		Probe:            m.probeResult(),
+		Shards:           m.shardStatuses(),
+	}
+	if m.knownRange != nil {
+		status.KnownRange = m.knownRange.String()
+	}
+	if m.blocksBehind >= 0 {
+		blocksBehind := m.blocksBehind
+		status.BlocksBehind = &blocksBehind
+	}
+	if m.config.Peer.enabled() {
+		status.Peer = m.config.Peer.Target
+		if m.peerLag >= 0 {
+			peerLag := m.peerLag
+			status.PeerLag = &peerLag
+		}
+	}
+	if len(m.consumers) > 0 {
+		status.Consumers = make(map[string]consumerState, len(m.consumers))
+		for name, state := range m.consumers {
+			status.Consumers[name] = *state
+		}
+	}
+	if !m.runtimeUnreachableSince.IsZero() {
+		status.Runtime = fmt.Sprintf("unreachable since %s: %s", m.runtimeUnreachableSince.Format(time.RFC3339), m.runtimeError)
+	}
+	if m.stalled {
+		status.StallSeconds = time.Since(m.lastProgressTime).Seconds()
+	}
+	now := time.Now()
+	if now.Before(m.pausedUntil) {
+		pausedUntil := m.pausedUntil
+		status.PausedUntil = &pausedUntil
+	}
+	if now.Before(m.cooldownUntil) {
+		cooldownUntil := m.cooldownUntil
+		status.CooldownUntil = &cooldownUntil
+	}
+	return status
+}
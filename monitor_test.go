@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+// recorder collects the events a monitor records.
+type recorder struct {
+	events []historyEvent
+}
+
+func (r *recorder) record(event historyEvent) {
+	r.events = append(r.events, event)
+}
+
+// outcomes returns the outcomes of the recorded events, in order, or nil
+// without any.
+func (r *recorder) outcomes() []string {
+	var outcomes []string
+	for _, event := range r.events {
+		outcomes = append(outcomes, event.Outcome)
+	}
+	return outcomes
+}
+
+// newTestMonitor returns a monitor for config without a height source. Its
+// restarts are refused as if one were already in progress, so that tests
+// reach the restart decision without running docker.
+func newTestMonitor(config TargetConfig) (*monitor, *recorder) {
+	if config.Name == "" {
+		config.Name = "test"
+	}
+	events := &recorder{}
+	return &monitor{
+		config:           config,
+		consumers:        make(map[string]*consumerState),
+		target:           config.Name,
+		events:           eventSinks{events},
+		lastBlockHeight:  -1,
+		lastProgressTime: time.Now(),
+		referenceHeight:  -1,
+		blocksBehind:     -1,
+		peerLag:          -1,
+		shards:           make(map[string]*shardState),
+		restarting:       true,
+	}, events
+}
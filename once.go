@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Output formats of a single-cycle run.
+const (
+	outputText   = "text"
+	outputNagios = "nagios"
+)
+
+// Nagios plugin states, which are also the process exit codes.
+const (
+	nagiosOK       = 0
+	nagiosWarning  = 1
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+var nagiosStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// monitorState is the part of a monitor that has to survive between
+// single-cycle runs for stalls to be detected across them.
+type monitorState struct {
+	BlockHeight             int64                      `json:"blockHeight"`
+	LastProgressTime        time.Time                  `json:"lastProgressTime"`
+	Stalled                 bool                       `json:"stalled,omitempty"`
+	RestartedAt             time.Time                  `json:"restartedAt"`
+	RestartedID             string                     `json:"restartedID,omitempty"`
+	CooldownUntil           time.Time                  `json:"cooldownUntil"`
+	PausedUntil             time.Time                  `json:"pausedUntil"`
+	Resyncing               bool                       `json:"resyncing,omitempty"`
+	ResyncStart             time.Time                  `json:"resyncStart"`
+	ResyncFromHeight        int64                      `json:"resyncFromHeight,omitempty"`
+	ResyncUntilHeight       int64                      `json:"resyncUntilHeight,omitempty"`
+	ProbeFailingSince       time.Time                  `json:"probeFailingSince"`
+	RuntimeUnreachableSince time.Time                  `json:"runtimeUnreachableSince"`
+	RuntimeRetryAt          time.Time                  `json:"runtimeRetryAt"`
+	RuntimeBackoff          time.Duration              `json:"runtimeBackoff,omitempty"`
+	RuntimeError            string                     `json:"runtimeError,omitempty"`
+	Uploads                 *uploadCounters            `json:"uploads,omitempty"`
+	UploadsFailingSince     time.Time                  `json:"uploadsFailingSince"`
+	UploadsNotified         bool                       `json:"uploadsNotified,omitempty"`
+	Consumers               map[string]consumerState   `json:"consumers,omitempty"`
+	PublishedHeight         int64                      `json:"publishedHeight,omitempty"`
+	PublishedAt             time.Time                  `json:"publishedAt"`
+	PeerLaggingSince        time.Time                  `json:"peerLaggingSince"`
+	PeerNotified            bool                       `json:"peerNotified,omitempty"`
+	PendingImage            string                     `json:"pendingImage,omitempty"`
+	ImageCheckedAt          time.Time                  `json:"imageCheckedAt"`
+	Shards                  map[string]savedShardState `json:"shards,omitempty"`
+	KnownRange              *KnownHeightRange          `json:"knownRange,omitempty"`
+}
+
+type savedShardState struct {
+	BlockHeight  int64     `json:"blockHeight"`
+	LastProgress time.Time `json:"lastProgress"`
+	Stalled      bool      `json:"stalled,omitempty"`
+}
+
+func (m *monitor) saveState() monitorState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shards := make(map[string]savedShardState, len(m.shards))
+	for shard, state := range m.shards {
+		shards[shard] = savedShardState{
+			BlockHeight:  state.height,
+			LastProgress: state.lastProgress,
+			Stalled:      state.stalled,
+		}
+	}
+	consumers := make(map[string]consumerState, len(m.consumers))
+	for name, state := range m.consumers {
+		consumers[name] = *state
+	}
+	var published heightReading
+	if reading := m.published.Load(); reading != nil {
+		published = *reading
+	}
+	return monitorState{
+		BlockHeight:             m.lastBlockHeight,
+		LastProgressTime:        m.lastProgressTime,
+		Stalled:                 m.stalled,
+		RestartedAt:             m.restartedAt,
+		RestartedID:             m.restartedID,
+		CooldownUntil:           m.cooldownUntil,
+		PausedUntil:             m.pausedUntil,
+		Resyncing:               m.resyncing,
+		ResyncStart:             m.resyncStart,
+		ResyncFromHeight:        m.resyncFromHeight,
+		ResyncUntilHeight:       m.resyncUntilHeight,
+		ProbeFailingSince:       m.probeFailingSince,
+		RuntimeUnreachableSince: m.runtimeUnreachableSince,
+		RuntimeRetryAt:          m.runtimeRetryAt,
+		RuntimeBackoff:          m.runtimeBackoff,
+		RuntimeError:            m.runtimeError,
+		Uploads:                 m.uploads,
+		UploadsFailingSince:     m.uploadsFailingSince,
+		UploadsNotified:         m.uploadsNotified,
+		Consumers:               consumers,
+		PublishedHeight:         published.height,
+		PublishedAt:             published.at,
+		PeerLaggingSince:        m.peerLaggingSince,
+		PeerNotified:            m.peerNotified,
+		PendingImage:            m.pendingImage,
+		ImageCheckedAt:          m.imageCheckedAt,
+		Shards:                  shards,
+		KnownRange:              m.knownRange,
+	}
+}
+
+func (m *monitor) restoreState(state monitorState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastBlockHeight = state.BlockHeight
+	m.lastProgressTime = state.LastProgressTime
+	m.stalled = state.Stalled
+	m.restartedAt = state.RestartedAt
+	m.restartedID = state.RestartedID
+	m.cooldownUntil = state.CooldownUntil
+	m.pausedUntil = state.PausedUntil
+	m.resyncing = state.Resyncing
+	m.resyncStart = state.ResyncStart
+	m.resyncFromHeight = state.ResyncFromHeight
+	m.resyncUntilHeight = state.ResyncUntilHeight
+	m.probeFailingSince = state.ProbeFailingSince
+	m.runtimeUnreachableSince = state.RuntimeUnreachableSince
+	m.runtimeRetryAt = state.RuntimeRetryAt
+	m.runtimeBackoff = state.RuntimeBackoff
+	m.runtimeError = state.RuntimeError
+	m.uploads = state.Uploads
+	m.uploadsFailingSince = state.UploadsFailingSince
+	m.uploadsNotified = state.UploadsNotified
+	for name, saved := range state.Consumers {
+		saved := saved
+		m.consumers[name] = &saved
+	}
+	m.pruneConsumers()
+	if !state.PublishedAt.IsZero() {
+		m.published.Store(&heightReading{height: state.PublishedHeight, at: state.PublishedAt})
+	}
+	m.peerLaggingSince = state.PeerLaggingSince
+	m.peerNotified = state.PeerNotified
+	m.pendingImage = state.PendingImage
+	m.imageCheckedAt = state.ImageCheckedAt
+	m.knownRange = state.KnownRange
+	for shard, saved := range state.Shards {
+		m.shards[shard] = &shardState{
+			height:       saved.BlockHeight,
+			lastProgress: saved.LastProgress,
+			stalled:      saved.Stalled,
+		}
+	}
+}
+
+// readState returns the saved state of every target. A missing file is an
+// empty state, as on the first run.
+func readState(path string) (map[string]monitorState, error) {
+	states := make(map[string]monitorState)
+	if path == "" {
+		return states, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	return states, nil
+}
+
+// writeState replaces the state file, going through a temporary file so
+// that an interrupted run does not leave it truncated.
+func writeState(path string, states map[string]monitorState) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// runOnce implements --once. Metrics, the admin API and config reloads are
+// left out, as the process exits after a single cycle.
+func runOnce(config Config, output string) int {
+	events, aws, err := openEventSinks(config)
+	if err != nil {
+		return fail(output, exitFatal, err)
+	}
+	s, err := newSupervisor(config, events)
+	if err != nil {
+		return fail(output, exitConfig, err)
+	}
+	code := s.runOnce(output)
+	if aws != nil {
+		aws.wait()
+	}
+	return code
+}
+
+// runOnce evaluates every target a single time, carrying monitor state over
+// from the previous run in config.StateFile, and returns the exit code.
+// Targets without saved state only take their initial reading.
+func (s *supervisor) runOnce(output string) int {
+	s.mu.Lock()
+	stateFile := s.config.StateFile
+	s.mu.Unlock()
+
+	states, err := readState(stateFile)
+	if err != nil {
+		return fail(output, exitFatal, err)
+	}
+
+	start := time.Now()
+	monitors := s.list()
+	for _, m := range monitors {
+		if m.process != nil {
+			return fail(output, exitConfig, fmt.Errorf("target %q: process mode requires a long-running supervisor", m.target))
+		}
+	}
+	// All state is restored before any evaluation, so that peers compare
+	// against each other's last reading.
+	for _, m := range monitors {
+		if state, ok := states[m.target]; ok {
+			m.restoreState(state)
+		}
+	}
+	s.forEach(monitors, func(m *monitor) {
+		if _, ok := states[m.target]; ok {
+			m.evaluate()
+		} else {
+			m.initialize()
+		}
+	})
+
+	states = make(map[string]monitorState, len(monitors))
+	results := make([]checkResult, 0, len(monitors))
+	for _, m := range monitors {
+		// An image update check runs to completion, to be applied by a later
+		// run.
+		m.imageCheck.Wait()
+		states[m.target] = m.saveState()
+		results = append(results, m.check(start))
+	}
+	if err := writeState(stateFile, states); err != nil {
+		return fail(output, exitFatal, err)
+	}
+
+	if output != outputNagios {
+		return exitOK
+	}
+	return printNagios(results)
+}
+
+// fail reports err and returns code, or the unknown state with nagios
+// output.
+func fail(output string, code int, err error) int {
+	if output == outputNagios {
+		fmt.Printf("NEAR LAKE UNKNOWN - %v\n", err)
+		return nagiosUnknown
+	}
+	log.Print(err)
+	return code
+}
+
+// checkResult is the Nagios view of one target after a cycle.
+type checkResult struct {
+	target       string
+	state        int
+	message      string
+	blockHeight  int64
+	blocksBehind int64
+	stallSeconds float64
+	threshold    time.Duration
+}
+
+// check classifies the target: critical once a stall or query failure has
+// outlasted the stall threshold, warning while the height is not
+// progressing or after a restart by the run that started at start, and OK
+// otherwise, including while paused or in the cooldown of an earlier run's
+// restart.
+func (m *monitor) check(start time.Time) checkResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	result := checkResult{
+		target:       m.target,
+		blockHeight:  m.lastBlockHeight,
+		blocksBehind: m.blocksBehind,
+		threshold:    m.stallTimeout(),
+	}
+	stall := now.Sub(m.lastProgressTime)
+	if m.stalled {
+		result.stallSeconds = stall.Seconds()
+	}
+	shard, shardStall := m.longestShardStall()
+	consumer, consumerLag := m.laggingConsumer()
+
+	switch {
+	case now.Before(m.pausedUntil):
+		result.message = fmt.Sprintf("%s paused until %s", m.target, m.pausedUntil.Format(time.RFC3339))
+	case !m.runtimeUnreachableSince.IsZero():
+		result.state = nagiosCritical
+		result.message = fmt.Sprintf("%s cannot be restarted, container runtime unreachable for %v: %s", m.target, now.Sub(m.runtimeUnreachableSince).Round(time.Second), m.runtimeError)
+	case !m.restartedAt.Before(start):
+		result.state = nagiosWarning
+		result.message = fmt.Sprintf("%s restarted by this run, in cooldown until %s", m.target, m.cooldownUntil.Format(time.RFC3339))
+	case now.Before(m.cooldownUntil):
+		result.message = fmt.Sprintf("%s restarted, in cooldown until %s", m.target, m.cooldownUntil.Format(time.RFC3339))
+	case m.lastError != "":
+		result.state = nagiosWarning
+		if stall > result.threshold {
+			result.state = nagiosCritical
+		}
+		result.message = fmt.Sprintf("%s query failing for %v: %s", m.target, stall.Round(time.Second), m.lastError)
+	case m.stalled:
+		result.state = nagiosWarning
+		if stall > result.threshold {
+			result.state = nagiosCritical
+		}
+		result.message = fmt.Sprintf("%s stalled at %d for %v (threshold %s)", m.target, m.lastBlockHeight, stall.Round(time.Second), formatThreshold(result.threshold))
+	case shard != "":
+		result.state = nagiosWarning
+		if shardStall > result.threshold {
+			result.state = nagiosCritical
+		}
+		result.message = fmt.Sprintf("%s at %d, shard %s stalled for %v (threshold %s)", m.target, m.lastBlockHeight, shard, shardStall.Round(time.Second), formatThreshold(result.threshold))
+	case m.probeError != "":
+		result.state = nagiosWarning
+		result.message = fmt.Sprintf("%s at %d, probe failing for %v: %s", m.target, m.lastBlockHeight, now.Sub(m.probeFailingSince).Round(time.Second), m.probeError)
+	case m.uploadsError != "":
+		result.state = nagiosWarning
+		if m.config.Uploads.Action == uploadsNotify && now.Sub(m.uploadsFailingSince) > m.config.Uploads.FailureTimeout {
+			result.state = nagiosCritical
+		}
+		result.message = fmt.Sprintf("%s at %d, uploads failing for %v: %s", m.target, m.lastBlockHeight, now.Sub(m.uploadsFailingSince).Round(time.Second), m.uploadsError)
+	case consumer != "":
+		result.state = nagiosWarning
+		if now.Sub(consumerLag.LaggingSince) > m.consumerLagTimeout(consumer) {
+			result.state = nagiosCritical
+		}
+		result.message = fmt.Sprintf("%s at %d, consumer %s lagging for %v: %s", m.target, m.lastBlockHeight, consumer, now.Sub(consumerLag.LaggingSince).Round(time.Second), consumerLag.Failure)
+	case !m.peerLaggingSince.IsZero():
+		result.state = nagiosWarning
+		result.message = fmt.Sprintf("%s at %d, %d blocks behind peer %s for %v", m.target, m.lastBlockHeight, m.peerLag, m.config.Peer.Target, now.Sub(m.peerLaggingSince).Round(time.Second))
+	case m.resyncing:
+		result.message = fmt.Sprintf("%s resyncing at %d", m.target, m.lastBlockHeight)
+	case m.blocksBehind >= 0:
+		result.message = fmt.Sprintf("%s at %d, %d blocks behind", m.target, m.lastBlockHeight, m.blocksBehind)
+	default:
+		result.message = fmt.Sprintf("%s at %d", m.target, m.lastBlockHeight)
+	}
+	return result
+}
+
+func formatThreshold(d time.Duration) string {
+	if d == stallSuppressed {
+		return "suppressed in a known height range"
+	}
+	return d.String()
+}
+
+// printNagios prints results as a single plugin output line with perfdata
+// and returns the worst state as the exit code.
+func printNagios(results []checkResult) int {
+	state := nagiosOK
+	messages := make([]string, 0, len(results))
+	perfdata := make([]string, 0, 3*len(results))
+	for _, result := range results {
+		if result.state > state {
+			state = result.state
+		}
+		messages = append(messages, result.message)
+		if result.blockHeight >= 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s_height'=%d", result.target, result.blockHeight))
+		}
+		if result.blocksBehind >= 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s_behind'=%d", result.target, result.blocksBehind))
+		}
+		critical := ""
+		if result.threshold != stallSuppressed {
+			critical = fmt.Sprintf("%.0f", result.threshold.Seconds())
+		}
+		perfdata = append(perfdata, fmt.Sprintf("'%s_stall'=%.0fs;0;%s;0", result.target, result.stallSeconds, critical))
+	}
+	fmt.Printf("NEAR LAKE %s - %s | %s\n", nagiosStateNames[state], strings.Join(messages, "; "), strings.Join(perfdata, " "))
+	return state
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventPeer marks a target starting to lag behind its peer past the lag
+// timeout, naming the peer as the authoritative instance, and catching up
+// again.
+const eventPeer = "peer"
+
+// PeerConfig cross-checks a target against a redundant indexer supervised as
+// another target. Both index the same chain, so the one that falls behind
+// is the one at fault, however healthy it looks on its own.
+type PeerConfig struct {
+	// Target names the peer's target.
+	Target string `yaml:"target"`
+	// MaxLag is how many blocks the target may trail the peer by for
+	// LagTimeout before only this target is restarted.
+	MaxLag     int64         `yaml:"maxLag"`
+	LagTimeout time.Duration `yaml:"lagTimeout"`
+}
+
+func (p PeerConfig) enabled() bool {
+	return p.Target != ""
+}
+
+func (p PeerConfig) validate() error {
+	if !p.enabled() {
+		if p != (PeerConfig{}) {
+			return fmt.Errorf("peer: target is required")
+		}
+		return nil
+	}
+	if p.MaxLag <= 0 {
+		return fmt.Errorf("peer: maxLag must be positive")
+	}
+	return nil
+}
+
+// heightReading is a successful block height reading, published for the
+// peers of a target without taking its lock.
+type heightReading struct {
+	height int64
+	at     time.Time
+}
+
+// publishHeight makes blockHeight the reading the target's peers compare
+// themselves against.
+func (m *monitor) publishHeight(blockHeight int64) {
+	m.published.Store(&heightReading{height: blockHeight, at: time.Now()})
+}
+
+// peerReading returns the latest reading of the configured peer, or nil
+// without one. It must be called without m.mu held, as it takes the
+// supervisor's lock.
+func (m *monitor) peerReading(config TargetConfig) *heightReading {
+	if !config.Peer.enabled() || m.lookup == nil {
+		return nil
+	}
+	peer := m.lookup(config.Peer.Target)
+	if peer == nil {
+		return nil
+	}
+	return peer.published.Load()
+}
+
+// checkPeer compares blockHeight with the peer's latest reading and restarts
+// the target once it has trailed the peer by more than maxLag for lagTimeout,
+// reporting whether it was restarted. A peer without a reading within the
+// last lagTimeout is no reference, and leaves the target to its own
+// thresholds. The caller must hold m.mu.
+func (m *monitor) checkPeer(reading *heightReading, blockHeight int64) bool {
+	config := m.config.Peer
+	if !config.enabled() {
+		return false
+	}
+	if reading == nil || time.Since(reading.at) > config.LagTimeout {
+		if !m.peerLaggingSince.IsZero() {
+			m.logf("No recent reading of peer %s, suspending the cross-check", config.Target)
+		}
+		m.peerLaggingSince = time.Time{}
+		m.peerLag = -1
+		peerLagGauge.DeletePartialMatch(map[string]string{"target": m.target})
+		return false
+	}
+
+	m.peerLag = reading.height - blockHeight
+	if m.peerLag < 0 {
+		m.peerLag = 0
+	}
+	peerLagGauge.WithLabelValues(m.target, config.Target).Set(float64(m.peerLag))
+	if m.peerLag <= config.MaxLag {
+		if !m.peerLaggingSince.IsZero() {
+			m.logf("Caught up with peer %s after lagging for %v", config.Target, time.Since(m.peerLaggingSince).Round(time.Second))
+			if m.peerNotified {
+				m.recordPeer(outcomeRecovered, "")
+			}
+		}
+		m.peerLaggingSince = time.Time{}
+		m.peerNotified = false
+		return false
+	}
+
+	if m.peerLaggingSince.IsZero() {
+		m.peerLaggingSince = time.Now()
+	}
+	lagging := time.Since(m.peerLaggingSince)
+	failure := fmt.Sprintf("%d blocks behind peer %s at %d (max %d)", m.peerLag, config.Target, reading.height, config.MaxLag)
+	m.logf("Lagging behind peer for %v: %s", lagging.Round(time.Second), failure)
+	if lagging < config.LagTimeout {
+		return false
+	}
+
+	if !m.peerNotified {
+		m.recordPeer(outcomeFailing, failure+", which is authoritative")
+		m.peerNotified = true
+	}
+	m.logf("Lagging behind peer %s for more than %v; %s is authoritative, restarting this target only", config.Target, config.LagTimeout, config.Target)
+	m.restart(reasonPeerLag)
+	// Give the restarted indexer a full lag timeout to catch up.
+	m.peerLaggingSince = time.Time{}
+	m.peerNotified = false
+	return true
+}
+
+func (m *monitor) recordPeer(outcome, failure string) {
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventPeer,
+		BlockHeight: m.lastBlockHeight,
+		Peer:        m.config.Peer.Target,
+		Outcome:     outcome,
+		Duration:    time.Since(m.peerLaggingSince),
+		Error:       failure,
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckPeer(t *testing.T) {
+	const lagTimeout = 5 * time.Minute
+	recent := func(height int64) *heightReading {
+		return &heightReading{height: height, at: time.Now()}
+	}
+
+	tests := []struct {
+		name         string
+		reading      *heightReading
+		blockHeight  int64
+		laggingSince time.Duration
+		notified     bool
+		restarted    bool
+		lagging      bool
+		lag          int64
+		outcomes     []string
+	}{
+		{name: "no reading", reading: nil, blockHeight: 100, lag: -1},
+		{name: "stale reading", reading: &heightReading{height: 1000, at: time.Now().Add(-2 * lagTimeout)}, blockHeight: 100, laggingSince: time.Minute, lag: -1},
+		{name: "within max lag", reading: recent(150), blockHeight: 100, lag: 50},
+		{name: "ahead of the peer", reading: recent(90), blockHeight: 100, lag: 0},
+		{name: "starts lagging", reading: recent(200), blockHeight: 100, lagging: true, lag: 100},
+		{name: "lagging within the timeout", reading: recent(200), blockHeight: 100, laggingSince: lagTimeout / 2, lagging: true, lag: 100},
+		{name: "lagging past the timeout", reading: recent(200), blockHeight: 100, laggingSince: 2 * lagTimeout, restarted: true, lag: 100, outcomes: []string{outcomeFailing}},
+		{name: "lagging past the timeout again", reading: recent(200), blockHeight: 100, laggingSince: 2 * lagTimeout, notified: true, restarted: true, lag: 100},
+		{name: "caught up", reading: recent(120), blockHeight: 100, laggingSince: 2 * lagTimeout, notified: true, lag: 20, outcomes: []string{outcomeRecovered}},
+	}
+	for _, test := range tests {
+		m, events := newTestMonitor(TargetConfig{Peer: PeerConfig{Target: "peer", MaxLag: 50, LagTimeout: lagTimeout}})
+		if test.laggingSince > 0 {
+			m.peerLaggingSince = time.Now().Add(-test.laggingSince)
+		}
+		m.peerNotified = test.notified
+
+		if restarted := m.checkPeer(test.reading, test.blockHeight); restarted != test.restarted {
+			t.Errorf("%s: checkPeer() = %v, want %v", test.name, restarted, test.restarted)
+		}
+		if lagging := !m.peerLaggingSince.IsZero(); lagging != test.lagging {
+			t.Errorf("%s: lagging = %v, want %v", test.name, lagging, test.lagging)
+		}
+		if m.peerLag != test.lag {
+			t.Errorf("%s: peerLag = %d, want %d", test.name, m.peerLag, test.lag)
+		}
+		if outcomes := events.outcomes(); !reflect.DeepEqual(outcomes, test.outcomes) {
+			t.Errorf("%s: recorded %v, want %v", test.name, outcomes, test.outcomes)
+		}
+	}
+}
+
+func TestCheckPeerDisabled(t *testing.T) {
+	m, events := newTestMonitor(TargetConfig{})
+	if m.checkPeer(&heightReading{height: 1000, at: time.Now()}, 100) {
+		t.Error("checkPeer() restarted a target without a peer")
+	}
+	if len(events.events) != 0 || m.peerLag != -1 {
+		t.Errorf("checkPeer() without a peer recorded %v and a lag of %d", events.events, m.peerLag)
+	}
+}
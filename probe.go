@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Probe types.
+const (
+	probeTCP  = "tcp"
+	probeHTTP = "http"
+)
+
+// ProbeConfig describes a liveness check of the indexer's RPC port, run
+// every cycle next to the height query. It tells a dead RPC behind a working
+// metrics endpoint apart from a dead process.
+type ProbeConfig struct {
+	// Type is tcp, which only connects to Addr, or http, which expects
+	// ExpectedStatus from a GET of URL. Empty disables the probe.
+	Type           string        `yaml:"type"`
+	Addr           string        `yaml:"addr"`
+	URL            string        `yaml:"url"`
+	ExpectedStatus int           `yaml:"expectedStatus"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// FailureTimeout is how long the probe may fail before the container is
+	// restarted even though the block height progresses. Zero only reports
+	// the probe result.
+	FailureTimeout time.Duration `yaml:"failureTimeout"`
+}
+
+func (p ProbeConfig) validate() error {
+	switch p.Type {
+	case "":
+	case probeTCP:
+		if p.Addr == "" {
+			return fmt.Errorf("probe.addr is required for tcp probes")
+		}
+	case probeHTTP:
+		if p.URL == "" {
+			return fmt.Errorf("probe.url is required for http probes")
+		}
+	default:
+		return fmt.Errorf("unknown probe.type %q", p.Type)
+	}
+	return nil
+}
+
+// run performs the probe and returns why it failed, or nil.
+func (p ProbeConfig) run(ctx context.Context) error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if p.Type == probeTCP {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", p.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	resp, err := httpGet(ctx, p.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	expected := p.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		return fmt.Errorf("%s returned status %d, expected %d", p.URL, resp.StatusCode, expected)
+	}
+	return nil
+}
+
+// recordProbe updates the probe state with the result of this cycle's probe
+// and reports whether the probe has been failing for longer than its
+// failure timeout. The caller must hold m.mu.
+func (m *monitor) recordProbe(err error) bool {
+	if m.config.Probe.Type == "" {
+		return false
+	}
+	if err == nil {
+		if !m.probeFailingSince.IsZero() {
+			m.logf("Probe succeeded again after failing for %v", time.Since(m.probeFailingSince).Round(time.Second))
+		}
+		m.probeFailingSince = time.Time{}
+		m.probeError = ""
+		probeUpGauge.WithLabelValues(m.target).Set(1)
+		return false
+	}
+
+	if m.probeFailingSince.IsZero() {
+		m.probeFailingSince = time.Now()
+	}
+	m.probeError = err.Error()
+	probeUpGauge.WithLabelValues(m.target).Set(0)
+	failing := time.Since(m.probeFailingSince)
+	m.logf("Probe failed for %v: %v", failing.Round(time.Second), err)
+	return m.config.Probe.FailureTimeout > 0 && failing > m.config.Probe.FailureTimeout
+}
+
+// probeResult describes the last probe for events and status, e.g. "up" or
+// "down: connection refused". It is empty without a probe. The caller must
+// hold m.mu.
+func (m *monitor) probeResult() string {
+	switch {
+	case m.config.Probe.Type == "":
+		return ""
+	case m.probeError != "":
+		return "down: " + m.probeError
+	default:
+		return "up"
+	}
+}
+
+// diagnosis names what a failing height query together with the probe
+// result says about the target. The caller must hold m.mu.
+func (m *monitor) diagnosis() string {
+	switch {
+	case m.config.Probe.Type == "":
+		return "height query failing"
+	case m.probeError != "":
+		return "height query and probe failing, the process looks dead"
+	default:
+		return "height query failing while the probe succeeds, the metrics endpoint looks dead"
+	}
+}
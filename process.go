@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProcessConfig runs the indexer as a child process of the supervisor
+// instead of a container, for deployments without Docker.
+type ProcessConfig struct {
+	Command []string `yaml:"command"`
+	Dir     string   `yaml:"dir"`
+	// Env lists KEY=VALUE pairs added to the supervisor's own environment.
+	Env []string `yaml:"env"`
+	// StopTimeout is how long the process has to exit after SIGTERM before
+	// it is killed. RestartDelay is the wait before starting it again after
+	// it exited on its own.
+	StopTimeout  time.Duration `yaml:"stopTimeout"`
+	RestartDelay time.Duration `yaml:"restartDelay"`
+}
+
+func (c ProcessConfig) enabled() bool {
+	return len(c.Command) > 0
+}
+
+func (c ProcessConfig) validate() error {
+	if !c.enabled() {
+		if c.Dir != "" || len(c.Env) > 0 || c.StopTimeout != 0 || c.RestartDelay != 0 {
+			return fmt.Errorf("process: command is required")
+		}
+		return nil
+	}
+	if c.StopTimeout <= 0 || c.RestartDelay < 0 {
+		return fmt.Errorf("process: stopTimeout must be positive and restartDelay not negative")
+	}
+	for _, env := range c.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("process: env entry %q is not KEY=VALUE", env)
+		}
+	}
+	return nil
+}
+
+// childProcess supervises one run after another of the indexer process.
+type childProcess struct {
+	target string
+	// exited is called when the process exits without being stopped.
+	exited func(err error)
+
+	mu     sync.Mutex
+	config ProcessConfig
+	cmd    *exec.Cmd
+	// done is closed once the current process has exited and its output
+	// has been copied.
+	done     chan struct{}
+	stopping bool
+}
+
+func newChildProcess(target string, config ProcessConfig, exited func(error)) *childProcess {
+	return &childProcess{target: target, config: config, exited: exited}
+}
+
+func (p *childProcess) logf(format string, args ...interface{}) {
+	log.Print(trace{target: p.target}.prefix() + fmt.Sprintf(format, args...))
+}
+
+// setConfig replaces the settings used from the next start on.
+func (p *childProcess) setConfig(config ProcessConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+}
+
+func (p *childProcess) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd != nil
+}
+
+// start starts the process unless it is already running. Its output is
+// logged line by line.
+func (p *childProcess) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil {
+		return nil
+	}
+
+	cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+	cmd.Dir = p.config.Dir
+	cmd.Env = append(os.Environ(), p.config.Env...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.config.Command[0], err)
+	}
+	p.logf("Started indexer process %d: %s", cmd.Process.Pid, strings.Join(p.config.Command, " "))
+
+	done := make(chan struct{})
+	p.cmd, p.done, p.stopping = cmd, done, false
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go p.copyOutput(stdout, &output)
+	go p.copyOutput(stderr, &output)
+	go func() {
+		// Wait closes the pipes, so the output has to be read first.
+		output.Wait()
+		err := cmd.Wait()
+
+		p.mu.Lock()
+		stopped := p.stopping
+		p.cmd = nil
+		p.mu.Unlock()
+		close(done)
+		if !stopped {
+			p.exited(err)
+		}
+	}()
+	return nil
+}
+
+func (p *childProcess) copyOutput(r io.Reader, output *sync.WaitGroup) {
+	defer output.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		p.logf("indexer: %s", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		p.logf("Warning: No longer logging the indexer's output: %v", err)
+		// Keep the pipe drained, so that the indexer does not block on it.
+		io.Copy(io.Discard, r)
+	}
+}
+
+// stop sends SIGTERM and waits for the process to exit, killing it after
+// stopTimeout or when ctx is done.
+func (p *childProcess) stop(ctx context.Context) error {
+	p.mu.Lock()
+	cmd, done, timeout := p.cmd, p.done, p.config.StopTimeout
+	if cmd != nil {
+		p.stopping = true
+	}
+	p.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	p.logf("Stopping indexer process %d", cmd.Process.Pid)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return p.kill(ctx)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		p.logf("Indexer process did not exit within %v", timeout)
+		return p.kill(ctx)
+	case <-ctx.Done():
+		if err := p.kill(context.Background()); err != nil {
+			return err
+		}
+		return fmt.Errorf("stopping indexer process: %w", ctx.Err())
+	}
+}
+
+// kill kills the process and waits for it to exit.
+func (p *childProcess) kill(ctx context.Context) error {
+	p.mu.Lock()
+	cmd, done := p.cmd, p.done
+	if cmd != nil {
+		p.stopping = true
+	}
+	p.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+
+	p.logf("Killing indexer process %d", cmd.Process.Pid)
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("killing indexer process: %w", ctx.Err())
+	}
+}
+
+func (p *childProcess) restart(ctx context.Context) error {
+	if err := p.stop(ctx); err != nil {
+		return err
+	}
+	return p.start()
+}
+
+func (p *childProcess) killAndStart(ctx context.Context) error {
+	if err := p.kill(ctx); err != nil {
+		return err
+	}
+	return p.start()
+}
+
+// processExited starts the process again after restartDelay when it exited
+// on its own, unless a restart of the cycle has started it in the meantime.
+func (m *monitor) processExited(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return
+	}
+	status := "with status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	delay := m.config.Process.RestartDelay
+	m.withoutCycle(func() {
+		m.logf("Indexer process exited (%s), starting it again in %v", status, delay)
+	})
+	time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.stopped || m.process.running() {
+			return
+		}
+		m.withoutCycle(func() {
+			m.restartWith(reasonProcessExit, func(context.Context, TargetConfig) error {
+				return m.process.start()
+			})
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var referenceClient = &http.Client{Timeout: 10 * time.Second}
+
+// nearStatusResponse is the part of a NEAR JSON-RPC status response we use.
+type nearStatusResponse struct {
+	Result struct {
+		SyncInfo struct {
+			LatestBlockHeight int64 `json:"latest_block_height"`
+		} `json:"sync_info"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// queryReferenceHeight returns the network head as reported by the NEAR RPC
+// node at url.
+func queryReferenceHeight(ctx context.Context, url string) (int64, error) {
+	request := []byte(`{"jsonrpc":"2.0","id":"near-lake-supervisor","method":"status","params":[]}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(request))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := referenceClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query reference RPC: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("reference RPC returned status %d", resp.StatusCode)
+	}
+
+	var status nearStatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("failed to decode reference RPC response: %w", err)
+	}
+	if status.Error != nil {
+		return 0, fmt.Errorf("reference RPC error: %s", status.Error.Message)
+	}
+	return status.Result.SyncInfo.LatestBlockHeight, nil
+}
+
+// updateBlocksBehind records how far blockHeight trails referenceHeight, the
+// reference head read in the same cycle. The distance is unknown without a
+// reference or when it could not be read. The caller must hold m.mu.
+func (m *monitor) updateBlocksBehind(config TargetConfig, blockHeight, referenceHeight int64, err error) {
+	m.referenceHeight, m.blocksBehind = -1, -1
+	if config.ReferenceRPC == "" {
+		blocksBehindGauge.DeleteLabelValues(m.target)
+		return
+	}
+	if err != nil {
+		m.logf("Warning: Failed to query reference head: %v", err)
+		blocksBehindGauge.DeleteLabelValues(m.target)
+		return
+	}
+	m.referenceHeight = referenceHeight
+	m.blocksBehind = referenceHeight - blockHeight
+	if m.blocksBehind < 0 {
+		// The reference node may itself lag behind the indexer's source.
+		m.blocksBehind = 0
+	}
+	blocksBehindGauge.WithLabelValues(m.target).Set(float64(m.blocksBehind))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce collapses the burst of events editors and config management
+// tools produce when replacing a file.
+const reloadDebounce = time.Second
+
+// restartOnlySettings are read once at startup. Changing them on a running
+// supervisor is reported but has no effect.
+var restartOnlySettings = []string{"startDelay", "workers", "metricsAddr", "historyFile", "adminAddr", "adminTokens", "adminTLS", "cloudwatch", "eventBridge", "selfUpdate", "chatOps"}
+
+// watchConfig reloads the config whenever the config file in dir changes or
+// the process receives SIGHUP.
+func (s *supervisor) watchConfig(dir string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Nil channels block forever, which disables file watching if the watcher
+	// cannot be set up.
+	var events chan fsnotify.Event
+	var errors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(dir)
+	}
+	if err != nil {
+		log.Printf("Warning: not watching %s for config changes, reload with SIGHUP: %v", dir, err)
+	} else {
+		events, errors = watcher.Events, watcher.Errors
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case event := <-events:
+			if isConfigFileEvent(event) {
+				debounce = time.After(reloadDebounce)
+			}
+		case err := <-errors:
+			log.Printf("Error watching config: %v", err)
+		case <-debounce:
+			debounce = nil
+			s.reload(dir)
+		case <-hup:
+			s.reload(dir)
+		}
+	}
+}
+
+func isConfigFileEvent(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	// Kubernetes updates mounted ConfigMaps by swapping the ..data symlink.
+	if name == "..data" {
+		return true
+	}
+	for _, candidate := range configCandidates {
+		if name == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *supervisor) reload(dir string) {
+	log.Printf("Reloading config")
+	config, err := LoadConfig(dir)
+	if err == nil {
+		err = s.apply(config)
+	}
+	if err != nil {
+		log.Printf("Failed to reload config, keeping the current one: %v", err)
+	}
+}
+
+// configChange is a single setting that differs between two configs.
+type configChange struct {
+	Path string
+	Old  string
+	New  string
+}
+
+func (c configChange) requiresRestart() bool {
+	for _, setting := range restartOnlySettings {
+		if c.Path == setting || strings.HasPrefix(c.Path, setting+".") || strings.HasPrefix(c.Path, setting+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+type configValue struct {
+	raw     string
+	display string
+}
+
+// diffConfig returns the settings that differ between old and new, ordered by
+// path. Paths use the YAML key names, with list entries keyed by their name
+// where they have one, e.g. targets[mainnet].stallTimeout. Targets are
+// compared with defaults applied, so that a changed top-level default shows up
+// on every target it affects. Values of fields tagged secret:"true" are
+// redacted.
+func diffConfig(old, new Config) []configChange {
+	if targets, err := old.targetConfigs(); err == nil {
+		old.Targets = targets
+	}
+	if targets, err := new.targetConfigs(); err == nil {
+		new.Targets = targets
+	}
+
+	oldValues := make(map[string]configValue)
+	newValues := make(map[string]configValue)
+	flattenConfig("", reflect.ValueOf(old), false, oldValues)
+	flattenConfig("", reflect.ValueOf(new), false, newValues)
+
+	paths := make([]string, 0, len(oldValues))
+	for path := range oldValues {
+		paths = append(paths, path)
+	}
+	for path := range newValues {
+		if _, ok := oldValues[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []configChange
+	for _, path := range paths {
+		oldValue, inOld := oldValues[path]
+		newValue, inNew := newValues[path]
+		if inOld && inNew && oldValue.raw == newValue.raw {
+			continue
+		}
+		change := configChange{Path: path, Old: "<unset>", New: "<unset>"}
+		if inOld {
+			change.Old = oldValue.display
+		}
+		if inNew {
+			change.New = newValue.display
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func flattenConfig(path string, v reflect.Value, secret bool, out map[string]configValue) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := field.Tag.Get("yaml")
+			if name == "" {
+				name = field.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			flattenConfig(name, v.Field(i), secret || field.Tag.Get("secret") == "true", out)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			key := strconv.Itoa(i)
+			if elem.Kind() == reflect.Struct {
+				if name := elem.FieldByName("Name"); name.IsValid() && name.String() != "" {
+					key = name.String()
+				}
+			}
+			flattenConfig(fmt.Sprintf("%s[%s]", path, key), elem, secret, out)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			flattenConfig(fmt.Sprintf("%s.%v", path, key.Interface()), v.MapIndex(key), secret, out)
+		}
+	default:
+		raw := fmt.Sprint(v.Interface())
+		display := raw
+		if secret {
+			display = "<redacted>"
+		} else if v.Kind() == reflect.String {
+			display = strconv.Quote(raw)
+		}
+		out[path] = configValue{raw: raw, display: display}
+	}
+}
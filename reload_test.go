@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reloadTestConfig returns a valid config with two targets, the second of
+// which sets its own stall timeout.
+func reloadTestConfig() Config {
+	return Config{
+		IndexerURL:               "http://indexer:3030",
+		QueryInterval:            30 * time.Second,
+		StallTimeout:             5 * time.Minute,
+		RestartSleep:             15 * time.Minute,
+		RestartTimeout:           30 * time.Second,
+		RestartTimeoutEscalation: escalationKill,
+		Workers:                  10,
+		MetricName:               "near_indexer_streaming_current_block_height",
+		ContainerName:            "near-lake-indexer",
+		SourceType:               sourcePrometheus,
+		MetricMode:               metricModeHeight,
+		Targets: []TargetConfig{
+			{Name: "mainnet", ContainerName: "mainnet"},
+			{Name: "testnet", ContainerName: "testnet", StallTimeout: 10 * time.Minute},
+		},
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []configChange
+	}{
+		{
+			name:   "unchanged",
+			change: func(c *Config) {},
+		},
+		{
+			name:   "inherited default",
+			change: func(c *Config) { c.StallTimeout = 6 * time.Minute },
+			want: []configChange{
+				{Path: "stallTimeout", Old: "5m0s", New: "6m0s"},
+				{Path: "targets[mainnet].stallTimeout", Old: "5m0s", New: "6m0s"},
+			},
+		},
+		{
+			name:   "target setting",
+			change: func(c *Config) { c.Targets[1].ContainerName = "testnet-2" },
+			want: []configChange{
+				{Path: "targets[testnet].containerName", Old: `"testnet"`, New: `"testnet-2"`},
+			},
+		},
+		{
+			name: "secret",
+			change: func(c *Config) {
+				c.AdminTokens = []AdminToken{{Token: "s3cret", Role: roleAdmin}}
+			},
+			want: []configChange{
+				{Path: "adminTokens[0].role", Old: "<unset>", New: `"admin"`},
+				{Path: "adminTokens[0].token", Old: "<unset>", New: "<redacted>"},
+			},
+		},
+	}
+	for _, test := range tests {
+		old, new := reloadTestConfig(), reloadTestConfig()
+		test.change(&new)
+		if got := diffConfig(old, new); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: diffConfig() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiffConfigTargetAdded(t *testing.T) {
+	old, new := reloadTestConfig(), reloadTestConfig()
+	new.Targets = append(new.Targets, TargetConfig{Name: "localnet", ContainerName: "localnet"})
+
+	changes := diffConfig(old, new)
+	if len(changes) == 0 {
+		t.Fatal("diffConfig() reported no changes")
+	}
+	for _, change := range changes {
+		if change.Old != "<unset>" || !strings.HasPrefix(change.Path, "targets[localnet].") {
+			t.Errorf("unexpected change %v", change)
+		}
+	}
+}
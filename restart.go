@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Dependent restart orders.
+const (
+	orderBefore = "before"
+	orderAfter  = "after"
+)
+
+// Escalations of a restart that exceeded restartTimeout.
+const (
+	escalationKill = "kill"
+	escalationNone = "none"
+)
+
+// DependentConfig is a companion container that is restarted together with
+// the target's container, such as a local proxy or a log shipper.
+type DependentConfig struct {
+	Container string `yaml:"container"`
+	// Order is before or after the target's container.
+	Order string `yaml:"order"`
+	// Delay separates this container from the target's: the wait after
+	// restarting a before dependent, or before restarting an after one.
+	Delay time.Duration `yaml:"delay"`
+}
+
+func (d DependentConfig) validate() error {
+	if d.Container == "" {
+		return fmt.Errorf("dependents: container is required")
+	}
+	if d.Order != orderBefore && d.Order != orderAfter {
+		return fmt.Errorf("dependents: unknown order %q for %s", d.Order, d.Container)
+	}
+	return nil
+}
+
+// restartGroup restarts the before dependents in the order they are listed,
+// then the target's container or process, then the after dependents, all
+// within ctx. Only a failure of the target's own restart fails it; failed
+// dependents are logged, and running out of time fails it at any point. It
+// runs without m.mu, on the config the restart started with.
+func (m *monitor) restartGroup(ctx context.Context, config TargetConfig) error {
+	for _, dependent := range config.Dependents {
+		if dependent.Order != orderBefore {
+			continue
+		}
+		if err := restartDependent(ctx, dependent); err != nil {
+			return err
+		}
+		if err := sleep(ctx, dependent.Delay); err != nil {
+			return err
+		}
+	}
+
+	if m.process != nil {
+		if err := m.process.restart(ctx); err != nil {
+			return err
+		}
+	} else if err := restartContainer(ctx, config.ContainerName); err != nil {
+		return err
+	}
+
+	for _, dependent := range config.Dependents {
+		if dependent.Order != orderAfter {
+			continue
+		}
+		if err := sleep(ctx, dependent.Delay); err != nil {
+			return err
+		}
+		if err := restartDependent(ctx, dependent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restartDependent restarts a dependent container, returning an error only
+// when ctx is done.
+func restartDependent(ctx context.Context, dependent DependentConfig) error {
+	if err := restartContainer(ctx, dependent.Container); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		tracef(ctx, "Warning: Failed to restart dependent container %s: %v", dependent.Container, err)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	tracef(ctx, "Waiting %v before the next restart in the group", d)
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting between restarts: %w", ctx.Err())
+	}
+}
+
+// killAndStart is the escalation of a timed out restart: the container is
+// killed rather than stopped gracefully, then started again, with a fresh
+// restartTimeout. A container the timed out restart already stopped is only
+// started.
+func killAndStart(ctx context.Context, config TargetConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, config.RestartTimeout)
+	defer cancel()
+
+	tracef(ctx, "Killing container: %s", config.ContainerName)
+	if err := docker(ctx, "kill", config.ContainerName); err != nil {
+		if !strings.Contains(err.Error(), "is not running") {
+			return err
+		}
+		tracef(ctx, "Container %s is not running, not killing it", config.ContainerName)
+	}
+	tracef(ctx, "Starting container: %s", config.ContainerName)
+	return docker(ctx, "start", config.ContainerName)
+}
+
+// restartOrder lists the containers of the target's restart group in the
+// order restartGroup restarts them.
+func restartOrder(config TargetConfig) []string {
+	var order []string
+	for _, dependent := range config.Dependents {
+		if dependent.Order == orderBefore {
+			order = append(order, dependent.Container)
+		}
+	}
+	order = append(order, config.ContainerName)
+	for _, dependent := range config.Dependents {
+		if dependent.Order == orderAfter {
+			order = append(order, dependent.Container)
+		}
+	}
+	return order
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// resyncHeadTolerance is how close to the reference head a resyncing target
+// has to get for the resync to count as complete.
+const resyncHeadTolerance = 100
+
+// Resync outcomes recorded in history.
+const (
+	outcomeStarted   = "started"
+	outcomeCompleted = "completed"
+)
+
+// Reasons a resync started for, recorded in history: a drop in block height
+// or progress far above the expected block rate.
+const (
+	resyncRegression = "regression"
+	resyncCatchUp    = "catch_up"
+)
+
+// startResync switches the monitor to the relaxed resync policy after the
+// block height dropped from the last observed height to blockHeight. The
+// caller must hold m.mu.
+func (m *monitor) startResync(blockHeight int64) {
+	m.logf("Block height dropped from %d to %d, treating this as a resync until the node catches up", m.lastBlockHeight, blockHeight)
+	m.beginResync(resyncRegression, blockHeight, m.lastBlockHeight)
+}
+
+// progressRate returns the blocks per second since the last progress, were
+// the block height to advance to blockHeight now. The caller must hold m.mu.
+func (m *monitor) progressRate(blockHeight int64) float64 {
+	elapsed := time.Since(m.lastProgressTime).Seconds()
+	if m.lastBlockHeight < 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(blockHeight-m.lastBlockHeight) / elapsed
+}
+
+// catchingUp reports whether rate is more than resyncCatchUpFactor times the
+// expected block rate.
+func catchingUp(config TargetConfig, rate float64) bool {
+	if config.ResyncCatchUpFactor <= 0 {
+		return false
+	}
+	return rate > config.ResyncCatchUpFactor/config.ExpectedBlockTime.Seconds()
+}
+
+// checkCatchUp switches the monitor to the relaxed resync policy when the
+// block height advances at rate, far above the expected block rate, as it
+// does while a node replays a backlog. The caller must hold m.mu.
+func (m *monitor) checkCatchUp(config TargetConfig, blockHeight int64, rate float64) {
+	if !catchingUp(config, rate) {
+		return
+	}
+	m.logf("Block height advancing at %.1f blocks/s, %.0f times the expected rate, treating this as a resync until the node catches up", rate, rate*config.ExpectedBlockTime.Seconds())
+	// Without a reference head, the resync lasts until the rate is back to
+	// normal.
+	m.beginResync(resyncCatchUp, m.lastBlockHeight, -1)
+}
+
+func (m *monitor) beginResync(reason string, fromHeight, untilHeight int64) {
+	m.resyncing = true
+	m.resyncStart = time.Now()
+	m.resyncFromHeight = fromHeight
+	m.resyncUntilHeight = untilHeight
+	resyncingGauge.WithLabelValues(m.target).Set(1)
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventResync,
+		BlockHeight: fromHeight,
+		Reason:      reason,
+		Outcome:     outcomeStarted,
+	})
+}
+
+// checkResync ends the resync once blockHeight has caught up with the
+// reference head read in this cycle, or with the height seen before the
+// regression when no reference is configured. A catch-up without a
+// reference ends once the progress rate of the cycle is back below
+// resyncCatchUpFactor. The caller must hold m.mu.
+func (m *monitor) checkResync(config TargetConfig, blockHeight int64, rate float64) {
+	elapsed := time.Since(m.resyncStart)
+	head := m.resyncUntilHeight
+	switch {
+	case config.ReferenceRPC != "":
+		if m.referenceHeight < 0 {
+			return
+		}
+		head = m.referenceHeight - resyncHeadTolerance
+	case head < 0:
+		if catchingUp(config, rate) {
+			m.logf("Resync catching up: %.1f blocks/s", rate)
+			return
+		}
+		head = blockHeight
+	}
+
+	if blockHeight < head {
+		rate := float64(blockHeight-m.resyncFromHeight) / elapsed.Seconds()
+		m.logf("Resync catching up: %d blocks behind, %.1f blocks/s", head-blockHeight, rate)
+		return
+	}
+
+	m.logf("Resync complete after %v at block height %d", elapsed.Round(time.Second), blockHeight)
+	m.resyncing = false
+	resyncingGauge.WithLabelValues(m.target).Set(0)
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventResync,
+		BlockHeight: blockHeight,
+		Outcome:     outcomeCompleted,
+		Duration:    elapsed,
+	})
+}
+
+// stallTimeout returns the stall threshold currently in force. The caller
+// must hold m.mu.
+func (m *monitor) stallTimeout() time.Duration {
+	return m.stallTimeoutIn(m.knownRange)
+}
+
+// publishStallThreshold exports the stall threshold currently in force, so
+// that the generated alert rules follow known height ranges and resyncs.
+// The caller must hold m.mu.
+func (m *monitor) publishStallThreshold() {
+	timeout := m.stallTimeout()
+	threshold := timeout.Seconds()
+	if timeout == stallSuppressed {
+		threshold = math.Inf(1)
+	}
+	stallThresholdGauge.WithLabelValues(m.target).Set(threshold)
+}
+
+// stallTimeoutIn returns the stall threshold within the known height range
+// r, which may be nil. The longest applicable threshold wins. The caller
+// must hold m.mu.
+func (m *monitor) stallTimeoutIn(r *KnownHeightRange) time.Duration {
+	timeout := m.config.StallTimeout
+	if m.resyncing && m.config.ResyncStallTimeout > timeout {
+		timeout = m.config.ResyncStallTimeout
+	}
+	if r != nil {
+		if r.Suppress {
+			return stallSuppressed
+		}
+		if r.StallTimeout > timeout {
+			timeout = r.StallTimeout
+		}
+	}
+	return timeout
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// errRuntimeUnreachable marks a docker command that failed because the
+// Docker daemon cannot be reached at all, rather than because of the
+// container. No restart can succeed until a human has fixed the host.
+var errRuntimeUnreachable = errors.New("container runtime unreachable")
+
+// runtimeUnreachableOutputs are the docker CLI's messages for a daemon that
+// is down, a socket that is missing or one the supervisor may not use.
+var runtimeUnreachableOutputs = []string{
+	"Cannot connect to the Docker daemon",
+	"permission denied while trying to connect to the Docker daemon socket",
+	"error during connect",
+}
+
+// Restarts are attempted again after runtimeBackoffMin while the runtime is
+// unreachable, doubling up to runtimeBackoffMax.
+const (
+	runtimeBackoffMin = time.Minute
+	runtimeBackoffMax = 15 * time.Minute
+)
+
+// eventRuntime records the container runtime becoming unreachable, with the
+// unreachable outcome, and reachable again, with the recovered outcome.
+const (
+	eventRuntime       = "runtime"
+	outcomeUnreachable = "unreachable"
+)
+
+// commandError describes a failed command with its output, wrapping
+// errRuntimeUnreachable when the output shows that the Docker daemon could
+// not be reached.
+func commandError(name string, err error, output []byte) error {
+	trimmed := strings.TrimSpace(string(output))
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("%s: %w: %v", name, errRuntimeUnreachable, err)
+	}
+	for _, message := range runtimeUnreachableOutputs {
+		if strings.Contains(trimmed, message) {
+			return fmt.Errorf("%s failed: %w: %s", name, errRuntimeUnreachable, trimmed)
+		}
+	}
+	if trimmed == "" {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return fmt.Errorf("%s failed: %w, output: %s", name, err, trimmed)
+}
+
+// runtimeBackingOff reports whether restarts are held back because the
+// container runtime was unreachable on the last attempt. The caller must hold
+// m.mu.
+func (m *monitor) runtimeBackingOff() bool {
+	if m.process != nil || !time.Now().Before(m.runtimeRetryAt) {
+		return false
+	}
+	m.logf("Cannot remediate: container runtime unreachable for %v, next restart attempt at %s",
+		time.Since(m.runtimeUnreachableSince).Round(time.Second), m.runtimeRetryAt.Format(time.RFC3339))
+	return true
+}
+
+// runtimeUnreachable backs off restarts after one failed on an unreachable
+// runtime and records the condition when it starts. The caller must hold
+// m.mu.
+func (m *monitor) runtimeUnreachable(err error) {
+	now := time.Now()
+	if m.runtimeUnreachableSince.IsZero() {
+		m.runtimeUnreachableSince = now
+		m.runtimeBackoff = runtimeBackoffMin
+		m.logf("Cannot remediate: the container runtime is unreachable, restarts need a human: %v", err)
+		m.record(historyEvent{
+			Target:      m.target,
+			Type:        eventRuntime,
+			BlockHeight: m.lastBlockHeight,
+			Outcome:     outcomeUnreachable,
+			Error:       err.Error(),
+		})
+	} else {
+		m.runtimeBackoff *= 2
+		if m.runtimeBackoff > runtimeBackoffMax {
+			m.runtimeBackoff = runtimeBackoffMax
+		}
+	}
+	m.runtimeError = err.Error()
+	m.runtimeRetryAt = now.Add(m.runtimeBackoff)
+	runtimeUpGauge.WithLabelValues(m.target).Set(0)
+	m.logf("Next restart attempt in %v", m.runtimeBackoff)
+}
+
+// runtimeReachable ends an unreachable runtime condition after a restart
+// went through. The caller must hold m.mu.
+func (m *monitor) runtimeReachable() {
+	if m.process != nil {
+		return
+	}
+	runtimeUpGauge.WithLabelValues(m.target).Set(1)
+	if m.runtimeUnreachableSince.IsZero() {
+		return
+	}
+	duration := time.Since(m.runtimeUnreachableSince)
+	m.logf("Container runtime reachable again after %v", duration.Round(time.Second))
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventRuntime,
+		BlockHeight: m.lastBlockHeight,
+		Outcome:     outcomeRecovered,
+		Duration:    duration,
+	})
+	m.runtimeUnreachableSince = time.Time{}
+	m.runtimeRetryAt = time.Time{}
+	m.runtimeBackoff = 0
+	m.runtimeError = ""
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// Release assets besides the binaries, which are named
+// near-lake-supervisor-<os>-<arch>.
+const (
+	checksumsAsset = "SHA256SUMS"
+	signatureAsset = "SHA256SUMS.sig"
+)
+
+// githubAPI is the base URL of the GitHub REST API.
+var githubAPI = "https://api.github.com"
+
+// selfUpdateTimeout bounds a check together with the download it leads to.
+const selfUpdateTimeout = 10 * time.Minute
+
+// SelfUpdateConfig installs new releases of the supervisor from GitHub.
+type SelfUpdateConfig struct {
+	// Repo is the GitHub repository whose releases are installed.
+	Repo string `yaml:"repo"`
+	// PublicKeyFile holds the PEM encoded Ed25519 key the checksums of a
+	// release are signed with. It is required for installs, unless a manual
+	// self-update explicitly skips the signature check.
+	PublicKeyFile string `yaml:"publicKeyFile"`
+	// Auto checks for a new release every CheckInterval while the supervisor
+	// runs, installs it and re-executes the new binary.
+	Auto          bool          `yaml:"auto"`
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+func (c SelfUpdateConfig) validate() error {
+	if c.Repo == "" || strings.Count(c.Repo, "/") != 1 {
+		return fmt.Errorf("selfUpdate: repo must be owner/name, got %q", c.Repo)
+	}
+	if !c.Auto {
+		return nil
+	}
+	if c.PublicKeyFile == "" {
+		return fmt.Errorf("selfUpdate: auto requires publicKeyFile")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("selfUpdate: checkInterval must be positive")
+	}
+	return nil
+}
+
+type githubRelease struct {
+	TagName string               `json:"tag_name"`
+	Assets  []githubReleaseAsset `json:"assets"`
+}
+
+type githubReleaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+func (r githubRelease) asset(name string) (githubReleaseAsset, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return githubReleaseAsset{}, false
+}
+
+func runVersion() int {
+	fmt.Println(version)
+	return exitOK
+}
+
+// runSelfUpdate implements the self-update subcommand.
+func runSelfUpdate(args []string) int {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := flags.Bool("check", false, "Only report whether a newer release is available")
+	tag := flags.String("version", "", "Install this release tag instead of the latest release")
+	force := flags.Bool("force", false, "Install the release even if it is not newer than the running version")
+	publicKey := flags.String("public-key", "", "PEM file of the Ed25519 release signing key (default: selfUpdate.publicKeyFile)")
+	skipSignature := flags.Bool("insecure-skip-signature", false, "Install without a public key, verifying only the checksums downloaded with the release")
+	flags.Parse(args)
+
+	config, err := LoadConfig("config")
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return exitConfig
+	}
+	if *publicKey != "" {
+		config.SelfUpdate.PublicKeyFile = *publicKey
+	}
+	if err := config.SelfUpdate.validate(); err != nil {
+		log.Print(err)
+		return exitConfig
+	}
+	// SHA256SUMS comes from the same release as the binary, so only its
+	// signature shows that the release is authentic.
+	if !*check && config.SelfUpdate.PublicKeyFile == "" && !*skipSignature {
+		log.Printf("self-update: a public key is required to verify the release, set selfUpdate.publicKeyFile or --public-key, or pass --insecure-skip-signature")
+		return exitConfig
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpdateTimeout)
+	defer cancel()
+	release, err := fetchRelease(ctx, config.SelfUpdate.Repo, *tag)
+	if err != nil {
+		log.Printf("Failed to look up release: %v", err)
+		return exitFatal
+	}
+	newer := newerVersion(release.TagName, version)
+	if !newer && !*force {
+		fmt.Printf("near-lake-supervisor %s is up to date (latest release: %s)\n", version, release.TagName)
+		return exitOK
+	}
+	if *check {
+		fmt.Printf("near-lake-supervisor %s can be updated to %s\n", version, release.TagName)
+		return exitOK
+	}
+	path, err := installRelease(ctx, config.SelfUpdate, release)
+	if err != nil {
+		log.Printf("Failed to install %s: %v", release.TagName, err)
+		return exitFatal
+	}
+	fmt.Printf("Installed near-lake-supervisor %s to %s, restart the supervisor to run it\n", release.TagName, path)
+	return exitOK
+}
+
+// autoUpdate checks for a new release every checkInterval and, once one is
+// installed, replaces the process with it.
+func autoUpdate(config SelfUpdateConfig) {
+	if version == "dev" {
+		log.Printf("Warning: Automatic updates are disabled in development builds")
+		return
+	}
+	log.Printf("Checking for new releases of %s every %v", config.Repo, config.CheckInterval)
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		path, err := updateOnce(config)
+		if err != nil {
+			log.Printf("Warning: Automatic update failed: %v", err)
+			continue
+		}
+		if path != "" {
+			reexec(path)
+		}
+	}
+}
+
+// updateOnce installs the latest release if it is newer than the running
+// version, and returns the path of the installed binary, if any.
+func updateOnce(config SelfUpdateConfig) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpdateTimeout)
+	defer cancel()
+	release, err := fetchRelease(ctx, config.Repo, "")
+	if err != nil {
+		return "", err
+	}
+	if !newerVersion(release.TagName, version) {
+		return "", nil
+	}
+	log.Printf("Installing near-lake-supervisor %s (running %s)", release.TagName, version)
+	return installRelease(ctx, config, release)
+}
+
+// reexec replaces the process with the binary at path, with the same
+// arguments and environment, after running the exit hooks.
+func reexec(path string) {
+	log.Printf("Restarting into %s", path)
+	runExitHooks()
+	err := syscall.Exec(path, os.Args, os.Environ())
+	fatalf(exitFatal, "Failed to restart into %s: %v", path, err)
+}
+
+// fetchRelease looks up the release with tag, or the latest release when tag
+// is empty. GITHUB_TOKEN, if set, authenticates the request.
+func fetchRelease(ctx context.Context, repo, tag string) (githubRelease, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", githubAPI, repo)
+	if tag != "" {
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", githubAPI, repo, tag)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return githubRelease{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return githubRelease{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return githubRelease{}, fmt.Errorf("GitHub API returned status %d for %s", resp.StatusCode, url)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return githubRelease{}, fmt.Errorf("failed to decode release: %w", err)
+	}
+	return release, nil
+}
+
+// installRelease downloads the release's binary for this platform, verifies
+// it against the signed checksums and replaces the running executable with
+// it. It returns the path of the executable.
+func installRelease(ctx context.Context, config SelfUpdateConfig, release githubRelease) (string, error) {
+	name := fmt.Sprintf("near-lake-supervisor-%s-%s", runtime.GOOS, runtime.GOARCH)
+	binary, ok := release.asset(name)
+	if !ok {
+		return "", fmt.Errorf("release %s has no %s asset", release.TagName, name)
+	}
+	checksums, err := downloadAsset(ctx, release, checksumsAsset)
+	if err != nil {
+		return "", err
+	}
+	if config.PublicKeyFile != "" {
+		signature, err := downloadAsset(ctx, release, signatureAsset)
+		if err != nil {
+			return "", err
+		}
+		if err := verifySignature(config.PublicKeyFile, checksums, signature); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("Warning: Skipping the signature check, %s is only verified against the checksums of its own release and may not be authentic", name)
+	}
+	expected, err := findChecksum(checksums, name)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", err
+	}
+	// The new binary is written next to the old one, so that the final
+	// rename replaces it atomically.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".near-lake-supervisor-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	err = download(ctx, binary.URL, io.MultiWriter(tmp, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return "", fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, actual, expected)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return "", err
+	}
+	// Make sure the binary runs on this host before replacing a working one.
+	output, err := exec.CommandContext(ctx, tmp.Name(), "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("downloaded binary does not run: %w", err)
+	}
+	if got := strings.TrimSpace(string(output)); got != strings.TrimPrefix(release.TagName, "v") {
+		return "", fmt.Errorf("downloaded binary reports version %q, want %s", got, release.TagName)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// downloadAsset downloads a small asset such as the checksums.
+func downloadAsset(ctx context.Context, release githubRelease, name string) ([]byte, error) {
+	asset, ok := release.asset(name)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s asset", release.TagName, name)
+	}
+	var buf bytes.Buffer
+	if err := download(ctx, asset.URL, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func download(ctx context.Context, url string, w io.Writer) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download returned status %d", resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// verifySignature checks the base64 encoded Ed25519 signature of data.
+func verifySignature(publicKeyFile string, data, signature []byte) error {
+	pemData, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read public key: %w", err)
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return fmt.Errorf("%s is not a PEM file", publicKeyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s is not an Ed25519 public key", publicKeyFile)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", signatureAsset, err)
+	}
+	if !ed25519.Verify(publicKey, data, sig) {
+		return fmt.Errorf("invalid signature of %s", checksumsAsset)
+	}
+	return nil
+}
+
+// findChecksum returns the checksum of name from sha256sum output.
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// newerVersion reports whether candidate is a newer x.y.z version than
+// current, with or without a v prefix. A development build is older than
+// every release.
+func newerVersion(candidate, current string) bool {
+	c, ok := parseVersion(candidate)
+	if !ok {
+		return false
+	}
+	r, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range c {
+		if c[i] != r[i] {
+			return c[i] > r[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(s string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [3]int
+		ok   bool
+	}{
+		{"1.2.3", [3]int{1, 2, 3}, true},
+		{"v1.2.3", [3]int{1, 2, 3}, true},
+		{"v10.0.12", [3]int{10, 0, 12}, true},
+		{"1.2", [3]int{}, false},
+		{"1.2.3.4", [3]int{}, false},
+		{"1.2.x", [3]int{}, false},
+		{"1.-2.3", [3]int{}, false},
+		{"dev", [3]int{}, false},
+		{"", [3]int{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseVersion(test.in)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("parseVersion(%q) = %v, %v, want %v, %v", test.in, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		candidate, current string
+		want               bool
+	}{
+		{"v1.2.4", "v1.2.3", true},
+		{"v1.3.0", "v1.2.9", true},
+		{"v2.0.0", "v1.10.10", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"1.2.4", "v1.2.3", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.2", "v1.2.3", false},
+		{"v0.9.9", "v1.0.0", false},
+		{"v1.0.0", "dev", true},
+		{"latest", "v1.0.0", false},
+		{"latest", "dev", false},
+	}
+	for _, test := range tests {
+		if got := newerVersion(test.candidate, test.current); got != test.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", test.candidate, test.current, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// shardState tracks the progress of one shard of a target.
+type shardState struct {
+	height       int64
+	lastProgress time.Time
+	stalled      bool
+}
+
+// queryShardHeights reads the per-shard series of config.ShardMetricName
+// from the indexer's metrics endpoint, keyed by the value of
+// config.ShardLabel.
+func queryShardHeights(ctx context.Context, config TargetConfig) (heights map[string]int64, err error) {
+	start := time.Now()
+	defer func() { observeQuery(config.Name, sourcePrometheus, pathShards, start, err) }()
+	families, err := fetchMetricFamilies(ctx, config.IndexerURL+"/metrics")
+	if err != nil {
+		return nil, err
+	}
+	family, ok := families[config.ShardMetricName]
+	if !ok {
+		return nil, fmt.Errorf("metric %s not found in response", config.ShardMetricName)
+	}
+
+	heights = make(map[string]int64)
+	for _, metric := range family.GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() != config.ShardLabel {
+				continue
+			}
+			heights[label.GetValue()] = int64(metricValue(metric))
+		}
+	}
+	if len(heights) == 0 {
+		return nil, fmt.Errorf("no %s series with a %s label", config.ShardMetricName, config.ShardLabel)
+	}
+	return heights, nil
+}
+
+// fetchMetricFamilies reads a metrics endpoint in the text exposition format.
+func fetchMetricFamilies(ctx context.Context, url string) (map[string]*dto.MetricFamily, error) {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint returned status %d", resp.StatusCode)
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %w", err)
+	}
+	return families, nil
+}
+
+// metricValue returns the value of a gauge, counter or untyped sample.
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Gauge != nil:
+		return metric.GetGauge().GetValue()
+	case metric.Counter != nil:
+		return metric.GetCounter().GetValue()
+	default:
+		return metric.GetUntyped().GetValue()
+	}
+}
+
+// updateShards records this cycle's shard heights and returns the shard
+// that has been stuck the longest beyond the stall threshold, if any.
+// Shards that are no longer reported are forgotten. The caller must hold
+// m.mu.
+func (m *monitor) updateShards(heights map[string]int64, err error) (string, time.Duration) {
+	if m.config.ShardMetricName == "" {
+		return "", 0
+	}
+	if err != nil {
+		m.logf("Warning: Failed to query shard heights: %v", err)
+		return "", 0
+	}
+
+	now := time.Now()
+	for shard := range m.shards {
+		if _, ok := heights[shard]; !ok {
+			delete(m.shards, shard)
+			shardBlockHeightGauge.DeleteLabelValues(m.target, shard)
+			shardStallSecondsGauge.DeleteLabelValues(m.target, shard)
+		}
+	}
+
+	shards := make([]string, 0, len(heights))
+	for shard := range heights {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	var stuck string
+	var longest time.Duration
+	threshold := m.stallTimeout()
+	for _, shard := range shards {
+		height := heights[shard]
+		state, ok := m.shards[shard]
+		if !ok || height != state.height {
+			m.shards[shard] = &shardState{height: height, lastProgress: now}
+			shardBlockHeightGauge.WithLabelValues(m.target, shard).Set(float64(height))
+			shardStallSecondsGauge.WithLabelValues(m.target, shard).Set(0)
+			continue
+		}
+
+		state.stalled = true
+		stall := now.Sub(state.lastProgress)
+		shardStallSecondsGauge.WithLabelValues(m.target, shard).Set(stall.Seconds())
+		m.logf("Shard %s stalled at %d for %v", shard, height, stall.Round(time.Second))
+		if stall > threshold && stall > longest {
+			stuck, longest = shard, stall
+		}
+	}
+	return stuck, longest
+}
+
+// resetShards restarts the stall clock of every shard. The caller must hold
+// m.mu.
+func (m *monitor) resetShards() {
+	now := time.Now()
+	for shard, state := range m.shards {
+		state.lastProgress = now
+		state.stalled = false
+		shardStallSecondsGauge.WithLabelValues(m.target, shard).Set(0)
+	}
+}
+
+// shardStatus is a shard's entry in monitorStatus.
+type shardStatus struct {
+	Shard        string  `json:"shard"`
+	BlockHeight  int64   `json:"blockHeight"`
+	StallSeconds float64 `json:"stallSeconds"`
+}
+
+// shardStatuses returns the shards ordered by name. The caller must hold
+// m.mu.
+func (m *monitor) shardStatuses() []shardStatus {
+	statuses := make([]shardStatus, 0, len(m.shards))
+	for shard, state := range m.shards {
+		status := shardStatus{Shard: shard, BlockHeight: state.height}
+		if state.stalled {
+			status.StallSeconds = time.Since(state.lastProgress).Seconds()
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Shard < statuses[j].Shard
+	})
+	return statuses
+}
+
+// longestShardStall returns the shard that has been stalled the longest.
+// The caller must hold m.mu.
+func (m *monitor) longestShardStall() (string, time.Duration) {
+	var stuck string
+	var longest time.Duration
+	for shard, state := range m.shards {
+		if stall := time.Since(state.lastProgress); state.stalled && stall > longest {
+			stuck, longest = shard, stall
+		}
+	}
+	return stuck, longest
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestUpdateShards(t *testing.T) {
+	const stallTimeout = 5 * time.Minute
+	// previous is the height of each shard in the last cycle, stalled since
+	// the given time ago.
+	type previous struct {
+		height int64
+		since  time.Duration
+	}
+
+	tests := []struct {
+		name     string
+		previous map[string]previous
+		heights  map[string]int64
+		err      error
+		stuck    string
+		shards   []string
+		stalled  []string
+	}{
+		{
+			name:    "first reading",
+			heights: map[string]int64{"0": 100, "1": 100},
+			shards:  []string{"0", "1"},
+		},
+		{
+			name:     "all progressing",
+			previous: map[string]previous{"0": {100, time.Minute}, "1": {100, 2 * stallTimeout}},
+			heights:  map[string]int64{"0": 101, "1": 101},
+			shards:   []string{"0", "1"},
+		},
+		{
+			name:     "stalled within the threshold",
+			previous: map[string]previous{"0": {100, time.Minute}, "1": {100, time.Minute}},
+			heights:  map[string]int64{"0": 100, "1": 101},
+			shards:   []string{"0", "1"},
+			stalled:  []string{"0"},
+		},
+		{
+			name:     "stuck shard",
+			previous: map[string]previous{"0": {100, time.Minute}, "1": {100, 2 * stallTimeout}},
+			heights:  map[string]int64{"0": 101, "1": 100},
+			stuck:    "1",
+			shards:   []string{"0", "1"},
+			stalled:  []string{"1"},
+		},
+		{
+			name:     "longest stuck shard",
+			previous: map[string]previous{"0": {100, 2 * stallTimeout}, "1": {100, 3 * stallTimeout}, "2": {100, 2 * stallTimeout}},
+			heights:  map[string]int64{"0": 100, "1": 100, "2": 100},
+			stuck:    "1",
+			shards:   []string{"0", "1", "2"},
+			stalled:  []string{"0", "1", "2"},
+		},
+		{
+			name:     "shard no longer reported",
+			previous: map[string]previous{"0": {100, time.Minute}, "1": {100, 2 * stallTimeout}},
+			heights:  map[string]int64{"0": 101},
+			shards:   []string{"0"},
+		},
+		{
+			name:     "query error",
+			previous: map[string]previous{"0": {100, 2 * stallTimeout}},
+			err:      errors.New("connection refused"),
+			shards:   []string{"0"},
+		},
+	}
+	for _, test := range tests {
+		m, _ := newTestMonitor(TargetConfig{StallTimeout: stallTimeout, ShardMetricName: "near_block_height", ShardLabel: "shard_id"})
+		for shard, p := range test.previous {
+			m.shards[shard] = &shardState{height: p.height, lastProgress: time.Now().Add(-p.since)}
+		}
+
+		stuck, stall := m.updateShards(test.heights, test.err)
+		if stuck != test.stuck {
+			t.Errorf("%s: updateShards() stuck = %q, want %q", test.name, stuck, test.stuck)
+		}
+		if (stuck != "") != (stall > stallTimeout) {
+			t.Errorf("%s: updateShards() stall = %v for stuck shard %q", test.name, stall, stuck)
+		}
+		var shards, stalled []string
+		for shard, state := range m.shards {
+			shards = append(shards, shard)
+			if state.stalled {
+				stalled = append(stalled, shard)
+			}
+		}
+		sort.Strings(shards)
+		sort.Strings(stalled)
+		if !reflect.DeepEqual(shards, test.shards) || !reflect.DeepEqual(stalled, test.stalled) {
+			t.Errorf("%s: shards %v, stalled %v, want %v, stalled %v", test.name, shards, stalled, test.shards, test.stalled)
+		}
+	}
+}
+
+func TestUpdateShardsDisabled(t *testing.T) {
+	m, _ := newTestMonitor(TargetConfig{StallTimeout: time.Minute})
+	if stuck, _ := m.updateShards(map[string]int64{"0": 100}, nil); stuck != "" || len(m.shards) != 0 {
+		t.Errorf("updateShards() without shardMetricName tracked %v", m.shards)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Source types.
+const (
+	sourcePrometheus = "prometheus"
+	sourceCloudWatch = "cloudwatch"
+	sourceLogs       = "logs"
+	sourceFile       = "file"
+	sourceRedis      = "redis"
+	sourcePostgres   = "postgres"
+	// sourcePrometheusServer is a central Prometheus or VictoriaMetrics
+	// server rather than the indexer's own endpoint.
+	sourcePrometheusServer = "prometheus-server"
+)
+
+// heightSource reports the current block height of a target.
+type heightSource interface {
+	queryHeight(ctx context.Context) (int64, error)
+}
+
+// newHeightSource builds the target's source, falling back to
+// FallbackSourceType when one is configured.
+func newHeightSource(config TargetConfig) (heightSource, error) {
+	primary, err := newSourceOfType(config, config.SourceType)
+	if err != nil || config.FallbackSourceType == "" {
+		return primary, err
+	}
+	fallback, err := newSourceOfType(config, config.FallbackSourceType)
+	if err != nil {
+		return nil, fmt.Errorf("fallback: %w", err)
+	}
+	return &fallbackSource{
+		target:       config.Name,
+		primary:      primary,
+		fallback:     fallback,
+		fallbackType: config.FallbackSourceType,
+	}, nil
+}
+
+func newSourceOfType(config TargetConfig, sourceType string) (heightSource, error) {
+	var source heightSource
+	var err error
+	switch sourceType {
+	case sourcePrometheus:
+		// Instrumented per path in queryBlockHeight.
+		return prometheusSource{config: config}, nil
+	case sourceCloudWatch:
+		source, err = newCloudWatchSource(config)
+	case sourceLogs:
+		source, err = newLogsSource(config)
+	case sourceFile:
+		source, err = newFileSource(config)
+	case sourceRedis:
+		source, err = newRedisSource(config)
+	case sourcePostgres:
+		source, err = newPostgresSource(config)
+	case sourcePrometheusServer:
+		source, err = newPrometheusServerSource(config)
+	default:
+		return nil, fmt.Errorf("unknown sourceType %q", sourceType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedSource{target: config.Name, sourceType: sourceType, source: source}, nil
+}
+
+// closeSource releases the connections held by sources that keep any.
+func closeSource(source heightSource) {
+	if closer, ok := source.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// prometheusSource reads the height from the indexer's own metrics endpoint,
+// trying the Prometheus query API before the text exposition format.
+type prometheusSource struct {
+	config TargetConfig
+}
+
+func (s prometheusSource) queryHeight(ctx context.Context) (int64, error) {
+	return queryBlockHeight(ctx, s.config)
+}
+
+// instrumentedSource records the latency and errors of a source's queries.
+type instrumentedSource struct {
+	target     string
+	sourceType string
+	source     heightSource
+}
+
+func (s *instrumentedSource) queryHeight(ctx context.Context) (int64, error) {
+	start := time.Now()
+	height, err := s.source.queryHeight(ctx)
+	observeQuery(s.target, s.sourceType, pathDefault, start, err)
+	return height, err
+}
+
+func (s *instrumentedSource) Close() error {
+	closeSource(s.source)
+	return nil
+}
+
+// fallbackSource queries the fallback only when the primary source fails, so
+// that a broken exporter alone does not look like a stall.
+type fallbackSource struct {
+	target       string
+	primary      heightSource
+	fallback     heightSource
+	fallbackType string
+}
+
+func (s *fallbackSource) queryHeight(ctx context.Context) (int64, error) {
+	height, err := s.primary.queryHeight(ctx)
+	if err == nil {
+		return height, nil
+	}
+	if traceFrom(ctx).target == "" {
+		ctx = withTrace(ctx, trace{target: s.target})
+	}
+	tracef(ctx, "Primary source failed, trying %s: %v", s.fallbackType, err)
+	height, fallbackErr := s.fallback.queryHeight(ctx)
+	if fallbackErr != nil {
+		return 0, fmt.Errorf("%w; %s fallback: %v", err, s.fallbackType, fallbackErr)
+	}
+	return height, nil
+}
+
+func (s *fallbackSource) Close() error {
+	closeSource(s.primary)
+	closeSource(s.fallback)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+type CloudWatchSourceConfig struct {
+	Region     string                `yaml:"region"`
+	Namespace  string                `yaml:"namespace"`
+	MetricName string                `yaml:"metricName"`
+	Dimensions []CloudWatchDimension `yaml:"dimensions"`
+	Statistic  string                `yaml:"statistic"`
+	Period     time.Duration         `yaml:"period"`
+	// Lookback is how far back to search for the latest datapoint.
+	Lookback time.Duration `yaml:"lookback"`
+}
+
+// CloudWatchDimension is a list entry rather than a map key, because config
+// keys are case-insensitive and CloudWatch dimension names are not.
+type CloudWatchDimension struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// cloudWatchSource reads the height from a metric the indexer's CloudWatch
+// agent publishes, for nodes that do not expose a Prometheus endpoint.
+type cloudWatchSource struct {
+	config CloudWatchSourceConfig
+	client *cloudwatch.Client
+}
+
+func newCloudWatchSource(target TargetConfig) (*cloudWatchSource, error) {
+	config := target.CloudWatchSource
+	if config.Namespace == "" {
+		return nil, fmt.Errorf("cloudwatchSource.namespace is required")
+	}
+	if config.MetricName == "" {
+		config.MetricName = target.MetricName
+	}
+	if config.Statistic == "" {
+		config.Statistic = "Maximum"
+	}
+	if config.Period == 0 {
+		config.Period = time.Minute
+	}
+	// GetMetricData rejects other periods for standard resolution metrics.
+	if config.Period < 0 || config.Period%time.Minute != 0 {
+		return nil, fmt.Errorf("cloudwatchSource.period must be a positive multiple of 60s")
+	}
+	if config.Lookback <= 0 {
+		config.Lookback = 5 * config.Period
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), awsRequestTimeout)
+	defer cancel()
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	return &cloudWatchSource{
+		config: config,
+		client: cloudwatch.NewFromConfig(awsConfig, func(o *cloudwatch.Options) {
+			if config.Region != "" {
+				o.Region = config.Region
+			}
+		}),
+	}, nil
+}
+
+func (s *cloudWatchSource) queryHeight(ctx context.Context) (int64, error) {
+	dimensions := make([]cloudwatchtypes.Dimension, 0, len(s.config.Dimensions))
+	for _, dimension := range s.config.Dimensions {
+		dimensions = append(dimensions, cloudwatchtypes.Dimension{
+			Name:  aws.String(dimension.Name),
+			Value: aws.String(dimension.Value),
+		})
+	}
+
+	now := time.Now()
+	output, err := s.client.GetMetricData(ctx, &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(now.Add(-s.config.Lookback)),
+		EndTime:   aws.Time(now),
+		ScanBy:    cloudwatchtypes.ScanByTimestampDescending,
+		MetricDataQueries: []cloudwatchtypes.MetricDataQuery{{
+			Id: aws.String("height"),
+			MetricStat: &cloudwatchtypes.MetricStat{
+				Metric: &cloudwatchtypes.Metric{
+					Namespace:  aws.String(s.config.Namespace),
+					MetricName: aws.String(s.config.MetricName),
+					Dimensions: dimensions,
+				},
+				Period: aws.Int32(int32(s.config.Period.Seconds())),
+				Stat:   aws.String(s.config.Statistic),
+			},
+		}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get CloudWatch metric data: %w", err)
+	}
+
+	for _, result := range output.MetricDataResults {
+		if len(result.Values) > 0 {
+			// Results are ordered newest first.
+			return int64(result.Values[0]), nil
+		}
+	}
+	return 0, fmt.Errorf("no %s datapoints in CloudWatch namespace %s within %v", s.config.MetricName, s.config.Namespace, s.config.Lookback)
+}
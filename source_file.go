@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FileSourceConfig struct {
+	// Path is either a file holding the height, or a directory whose entries
+	// are named after block heights, such as the lake's local staging
+	// directory, in which case the highest entry is the height.
+	Path string `yaml:"path"`
+	// MaxAge fails the query when the file, or the highest entry, has not
+	// been modified for this long. Zero disables the check.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// fileSource reads the height from disk, for setups where the indexer's
+// metrics port cannot be reached from the supervisor.
+type fileSource struct {
+	config FileSourceConfig
+}
+
+func newFileSource(target TargetConfig) (*fileSource, error) {
+	if target.FileSource.Path == "" {
+		return nil, fmt.Errorf("fileSource.path is required")
+	}
+	return &fileSource{config: target.FileSource}, nil
+}
+
+func (s *fileSource) queryHeight(ctx context.Context) (int64, error) {
+	info, err := os.Stat(s.config.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	path := s.config.Path
+	var height int64
+	if info.IsDir() {
+		height, info, err = highestEntry(path)
+		if err == nil {
+			path = filepath.Join(path, info.Name())
+		}
+	} else {
+		height, err = readHeightFile(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if age := time.Since(info.ModTime()); s.config.MaxAge > 0 && age > s.config.MaxAge {
+		return 0, fmt.Errorf("%s has not been updated for %v", path, age.Round(time.Second))
+	}
+	return height, nil
+}
+
+func readHeightFile(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse height in %s: %w", path, err)
+	}
+	return height, nil
+}
+
+// highestEntry returns the highest height among the entries of dir whose
+// names start with digits, e.g. "000104253112" or "104253112.json".
+func highestEntry(dir string) (int64, os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	height := int64(-1)
+	var highest os.DirEntry
+	for _, entry := range entries {
+		name := entry.Name()
+		digits := len(name) - len(strings.TrimLeft(name, "0123456789"))
+		if digits == 0 {
+			continue
+		}
+		value, err := strconv.ParseInt(name[:digits], 10, 64)
+		if err != nil || value <= height {
+			continue
+		}
+		height, highest = value, entry
+	}
+	if highest == nil {
+		return 0, nil, fmt.Errorf("no entries named after block heights in %s", dir)
+	}
+
+	info, err := highest.Info()
+	if err != nil {
+		return 0, nil, err
+	}
+	return height, info, nil
+}
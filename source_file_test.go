@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHighestEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    int64
+		wantOK  bool
+		highest string
+	}{
+		{"padded directories", []string{"000104253110/", "000104253112/", "000104253111/"}, 104253112, true, "000104253112"},
+		{"files with suffixes", []string{"104253112.json", "104253113.json", "104253111.json"}, 104253113, true, "104253113.json"},
+		{"other entries", []string{"latest", ".lock", "104253112", "tmp-104253199"}, 104253112, true, "104253112"},
+		{"no heights", []string{"latest", "index.json"}, 0, false, ""},
+		{"empty", nil, 0, false, ""},
+		{"out of range", []string{"99999999999999999999", "42"}, 42, true, "42"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for _, entry := range test.entries {
+			path := filepath.Join(dir, entry)
+			var err error
+			if entry[len(entry)-1] == '/' {
+				err = os.Mkdir(path, 0o755)
+			} else {
+				err = os.WriteFile(path, nil, 0o644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		height, info, err := highestEntry(dir)
+		if (err == nil) != test.wantOK {
+			t.Errorf("%s: highestEntry() error = %v, want ok %v", test.name, err, test.wantOK)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if height != test.want || info.Name() != test.highest {
+			t.Errorf("%s: highestEntry() = %d, %s, want %d, %s", test.name, height, info.Name(), test.want, test.highest)
+		}
+	}
+}
+
+func TestHighestEntryMissingDir(t *testing.T) {
+	if _, _, err := highestEntry(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("highestEntry() of a missing directory succeeded")
+	}
+}
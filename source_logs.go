@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// defaultLogsPattern matches the height in the periodic stats line nearcore
+// logs, e.g. "INFO stats: #104253112 Downloading blocks".
+const defaultLogsPattern = `stats: #\s*(\d+)`
+
+type LogsSourceConfig struct {
+	// Pattern is a regular expression whose first capture group, or the
+	// group named "height", is the block height.
+	Pattern string `yaml:"pattern"`
+	// Since limits the search to lines logged within this period, so that a
+	// silent container does not keep reporting an old height.
+	Since time.Duration `yaml:"since"`
+}
+
+// logsSource reads the height from the container's logs, for indexer builds
+// whose metrics exporter can fail while block processing continues.
+type logsSource struct {
+	container string
+	pattern   *regexp.Regexp
+	group     int
+	since     time.Duration
+}
+
+func newLogsSource(target TargetConfig) (*logsSource, error) {
+	config := target.LogsSource
+	if config.Pattern == "" {
+		config.Pattern = defaultLogsPattern
+	}
+	if config.Since <= 0 {
+		config.Since = 5 * time.Minute
+	}
+	if target.ContainerName == "" {
+		return nil, fmt.Errorf("the logs source requires containerName")
+	}
+
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid logsSource.pattern: %w", err)
+	}
+	group := pattern.SubexpIndex("height")
+	if group < 0 {
+		if pattern.NumSubexp() == 0 {
+			return nil, fmt.Errorf("logsSource.pattern needs a capture group for the height")
+		}
+		group = 1
+	}
+
+	return &logsSource{
+		container: target.ContainerName,
+		pattern:   pattern,
+		group:     group,
+		since:     config.Since,
+	}, nil
+}
+
+func (s *logsSource) queryHeight(ctx context.Context) (int64, error) {
+	cmd := exec.CommandContext(ctx, "docker", "logs", "--timestamps", "--since", s.since.String(), s.container)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("docker logs failed: %w, output: %s", err, string(output))
+	}
+
+	// The container's stdout and stderr arrive interleaved, so the newest
+	// match is picked by its timestamp rather than its position.
+	var newest time.Time
+	height := int64(-1)
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		timestamp, line, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, string(timestamp))
+		if err != nil || t.Before(newest) {
+			continue
+		}
+		match := s.pattern.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+		value, err := strconv.ParseInt(string(match[s.group]), 10, 64)
+		if err != nil {
+			continue
+		}
+		newest, height = t, value
+	}
+	if height < 0 {
+		return 0, fmt.Errorf("no block height in the logs of %s within %v", s.container, s.since)
+	}
+	return height, nil
+}
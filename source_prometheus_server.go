@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PrometheusServerSourceConfig struct {
+	// URL is the server's base URL, e.g. http://prometheus:9090 or
+	// http://victoriametrics:8428, under which /api/v1/query is served.
+	URL string `yaml:"url"`
+	// Selector picks the target's series of metricName, e.g.
+	// {job="near-lake",instance="indexer-1:3030"}. Query, if set, is used
+	// as is instead of max(metricName selector).
+	Selector string `yaml:"selector"`
+	Query    string `yaml:"query"`
+	// Username and Password enable basic auth, BearerToken a bearer token.
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password" secret:"true"`
+	BearerToken string        `yaml:"bearerToken" secret:"true"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// prometheusServerSource reads the height from a central Prometheus or
+// VictoriaMetrics server, which keeps answering when the indexer's own HTTP
+// server is wedged along with the process.
+type prometheusServerSource struct {
+	config PrometheusServerSourceConfig
+	query  string
+}
+
+func newPrometheusServerSource(target TargetConfig) (*prometheusServerSource, error) {
+	config := target.PrometheusServerSource
+	if config.URL == "" {
+		return nil, fmt.Errorf("prometheusServerSource.url is required")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("prometheusServerSource.url: %w", err)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	query := config.Query
+	if query == "" {
+		query = fmt.Sprintf("max(%s%s)", target.MetricName, config.Selector)
+	}
+	return &prometheusServerSource{config: config, query: query}, nil
+}
+
+func (s *prometheusServerSource) queryHeight(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	endpoint := strings.TrimSuffix(s.config.URL, "/") + "/api/v1/query?" + url.Values{"query": {s.query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	} else if s.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query Prometheus server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("query API returned status %d", resp.StatusCode)
+	}
+	var promResp PrometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&promResp); err != nil {
+		return 0, fmt.Errorf("failed to decode query response: %w", err)
+	}
+	if promResp.Status != "success" || promResp.Data.ResultType != "vector" {
+		return 0, fmt.Errorf("query %s did not return a vector", s.query)
+	}
+
+	// A series the server no longer scrapes drops out of the result once it
+	// has gone stale, which makes an unreachable indexer a failed query.
+	switch len(promResp.Data.Result) {
+	case 0:
+		return 0, fmt.Errorf("query %s returned no result", s.query)
+	case 1:
+	default:
+		return 0, fmt.Errorf("query %s returned %d series, narrow it down with selector", s.query, len(promResp.Data.Result))
+	}
+	value := promResp.Data.Result[0].Value
+	if len(value) != 2 {
+		return 0, fmt.Errorf("query %s returned a malformed sample", s.query)
+	}
+	valueStr, ok := value[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("query %s returned a non-string value", s.query)
+	}
+	height, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(height), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisSourceConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	DB       int    `yaml:"db"`
+	// Key holds the height. With Field set it is a hash and the height is
+	// stored in that field.
+	Key   string `yaml:"key"`
+	Field string `yaml:"field"`
+	// TLS enables TLS, verified against the system roots or CAFile.
+	TLS    bool   `yaml:"tls"`
+	CAFile string `yaml:"caFile"`
+}
+
+// redisSource reads the last height a downstream consumer processed, so that
+// stalls anywhere in the pipeline are detected, not only in the indexer.
+type redisSource struct {
+	config RedisSourceConfig
+	client *redis.Client
+}
+
+func newRedisSource(target TargetConfig) (*redisSource, error) {
+	config := target.RedisSource
+	if config.Addr == "" || config.Key == "" {
+		return nil, fmt.Errorf("redisSource.addr and redisSource.key are required")
+	}
+
+	options := &redis.Options{
+		Addr:     config.Addr,
+		Username: config.Username,
+		Password: config.Password,
+		DB:       config.DB,
+	}
+	if config.TLS {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.CAFile != "" {
+			pem, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read redisSource.caFile: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in redisSource.caFile")
+			}
+			options.TLSConfig.RootCAs = pool
+		}
+	}
+
+	return &redisSource{config: config, client: redis.NewClient(options)}, nil
+}
+
+func (s *redisSource) queryHeight(ctx context.Context) (int64, error) {
+	var value string
+	var err error
+	if s.config.Field != "" {
+		value, err = s.client.HGet(ctx, s.config.Key, s.config.Field).Result()
+	} else {
+		value, err = s.client.Get(ctx, s.config.Key).Result()
+	}
+	if errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("redis key %s is not set", s.config.Key)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read redis key %s: %w", s.config.Key, err)
+	}
+
+	height, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse height in redis key %s: %w", s.config.Key, err)
+	}
+	return height, nil
+}
+
+func (s *redisSource) Close() error {
+	return s.client.Close()
+}
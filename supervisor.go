@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// supervisor owns the monitors of all configured targets and evaluates them
+// on a shared ticker.
+type supervisor struct {
+	events eventSinks
+
+	// intervalChanges carries a reloaded queryInterval to the run loop.
+	intervalChanges chan time.Duration
+	// workers bounds the number of targets evaluated at the same time.
+	workers chan struct{}
+
+	mu       sync.Mutex
+	config   Config
+	monitors map[string]*monitor
+}
+
+func newSupervisor(config Config, events eventSinks) (*supervisor, error) {
+	targets, err := config.targetConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &supervisor{
+		events:          events,
+		intervalChanges: make(chan time.Duration, 1),
+		workers:         make(chan struct{}, config.Workers),
+		config:          config,
+		monitors:        make(map[string]*monitor),
+	}
+	for _, target := range targets {
+		if _, err := s.startMonitor(target); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// startProcesses starts the indexer processes of all targets in process
+// mode.
+func (s *supervisor) startProcesses() {
+	for _, m := range s.list() {
+		m.startProcess()
+	}
+}
+
+// initialize takes the initial block height reading of every target.
+func (s *supervisor) initialize() {
+	s.forEach(s.list(), (*monitor).initialize)
+}
+
+// forEach runs f for every monitor on the worker pool and waits for all of
+// them.
+func (s *supervisor) forEach(monitors []*monitor, f func(*monitor)) {
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		wg.Add(1)
+		go func(m *monitor) {
+			defer wg.Done()
+			s.workers <- struct{}{}
+			defer func() { <-s.workers }()
+			f(m)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// evaluateAll starts an evaluation of every target on the worker pool
+// without waiting for them, so that a slow target does not delay the others.
+// A target whose previous evaluation is still queued or running skips this
+// tick.
+func (s *supervisor) evaluateAll() {
+	for _, m := range s.list() {
+		if !m.scheduled.CompareAndSwap(false, true) {
+			log.Printf("%sPrevious evaluation still running, skipping this one", trace{target: m.target}.prefix())
+			evaluationsSkippedTotal.WithLabelValues(m.target).Inc()
+			continue
+		}
+		go func(m *monitor) {
+			defer m.scheduled.Store(false)
+			s.workers <- struct{}{}
+			defer func() { <-s.workers }()
+			m.evaluate()
+		}(m)
+	}
+}
+
+func (s *supervisor) run() {
+	s.mu.Lock()
+	interval := s.config.QueryInterval
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.evaluateAll()
+		case interval := <-s.intervalChanges:
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// startMonitor adds a monitor for target, which the run loop picks up on its
+// next tick. The caller must hold s.mu or be the only user of s.
+func (s *supervisor) startMonitor(target TargetConfig) (*monitor, error) {
+	m, err := newMonitor(target, s.events)
+	if err != nil {
+		return nil, err
+	}
+	m.lookup = s.peerMonitor
+	s.monitors[target.Name] = m
+	return m, nil
+}
+
+// stopMonitor stops monitoring the named target and drops its metrics, and
+// returns the monitor, whose process the caller stops once it has released
+// s.mu. The caller must hold s.mu.
+func (s *supervisor) stopMonitor(name string) *monitor {
+	m := s.monitors[name]
+	config := m.stop()
+	delete(s.monitors, name)
+
+	labels := prometheus.Labels{"target": name}
+	blockHeightGauge.DeletePartialMatch(labels)
+	stallSecondsGauge.DeletePartialMatch(labels)
+	stallThresholdGauge.DeletePartialMatch(labels)
+	blockTimestampGauge.DeletePartialMatch(labels)
+	resyncingGauge.DeletePartialMatch(labels)
+	probeUpGauge.DeletePartialMatch(labels)
+	runtimeUpGauge.DeletePartialMatch(labels)
+	uploadsUpGauge.DeletePartialMatch(labels)
+	uploadErrorRateGauge.DeletePartialMatch(labels)
+	shardBlockHeightGauge.DeletePartialMatch(labels)
+	shardStallSecondsGauge.DeletePartialMatch(labels)
+	restartsTotal.DeletePartialMatch(labels)
+	stallDurationSeconds.DeletePartialMatch(labels)
+	recoveryDurationSeconds.DeletePartialMatch(labels)
+	sourceQueryDurationSeconds.DeletePartialMatch(labels)
+	sourceQueryErrorsTotal.DeletePartialMatch(labels)
+	evaluationsSkippedTotal.DeletePartialMatch(labels)
+	blocksBehindGauge.DeletePartialMatch(labels)
+	consumerLagGauge.DeletePartialMatch(labels)
+	peerLagGauge.DeletePartialMatch(labels)
+	consumerUpGauge.DeletePartialMatch(labels)
+	for _, c := range config.Consumers {
+		consumerLabels := prometheus.Labels{"target": c.metricsTarget(name)}
+		sourceQueryDurationSeconds.DeletePartialMatch(consumerLabels)
+		sourceQueryErrorsTotal.DeletePartialMatch(consumerLabels)
+	}
+	return m
+}
+
+// stopProcesses stops the indexer processes of all targets in process mode,
+// in parallel as each may take up to its stopTimeout.
+func (s *supervisor) stopProcesses() {
+	var wg sync.WaitGroup
+	for _, m := range s.list() {
+		if m.process == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(m *monitor) {
+			defer wg.Done()
+			m.stopProcess()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// list returns the monitors ordered by target name.
+func (s *supervisor) list() []*monitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	monitors := make([]*monitor, 0, len(s.monitors))
+	for _, m := range s.monitors {
+		monitors = append(monitors, m)
+	}
+	sort.Slice(monitors, func(i, j int) bool {
+		return monitors[i].target < monitors[j].target
+	})
+	return monitors
+}
+
+// monitor returns the monitor of the named target. An empty name selects the
+// only target when exactly one is configured.
+func (s *supervisor) monitor(name string) (*monitor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		if len(s.monitors) != 1 {
+			return nil, fmt.Errorf("%d targets configured, a target name is required", len(s.monitors))
+		}
+		for _, m := range s.monitors {
+			return m, nil
+		}
+	}
+	m, ok := s.monitors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", name)
+	}
+	return m, nil
+}
+
+// peerMonitor returns the monitor of the named target, or nil. Monitors must
+// not call it while holding their own lock, as apply takes the locks the
+// other way around.
+func (s *supervisor) peerMonitor(name string) *monitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.monitors[name]
+}
+
+// apply brings the running supervisor in line with a reloaded config. Target
+// and threshold changes take effect immediately; settings that are only read
+// at startup are reported and otherwise ignored.
+func (s *supervisor) apply(config Config) error {
+	targets, err := config.targetConfigs()
+	if err != nil {
+		return err
+	}
+
+	// Removed monitors stop their process, and new monitors start theirs and
+	// take their initial reading, once the lock is released, so that a slow
+	// indexer does not hold up the others.
+	var stopped, started []*monitor
+	defer func() {
+		s.forEach(stopped, (*monitor).stopProcess)
+		s.forEach(started, func(m *monitor) {
+			m.startProcess()
+			m.initialize()
+		})
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := diffConfig(s.config, config)
+	if len(changes) == 0 {
+		log.Printf("Config reloaded, no changes")
+		return nil
+	}
+	for _, change := range changes {
+		log.Printf("Config changed: %s: %s -> %s", change.Path, change.Old, change.New)
+		if change.requiresRestart() {
+			log.Printf("Warning: change to %s requires a restart to take effect", change.Path)
+		}
+	}
+
+	if config.QueryInterval != s.config.QueryInterval {
+		// Replace a change the run loop has not picked up yet.
+		select {
+		case <-s.intervalChanges:
+		default:
+		}
+		s.intervalChanges <- config.QueryInterval
+	}
+
+	wanted := make(map[string]TargetConfig, len(targets))
+	for _, target := range targets {
+		wanted[target.Name] = target
+	}
+	for name := range s.monitors {
+		if _, ok := wanted[name]; !ok {
+			stopped = append(stopped, s.stopMonitor(name))
+			log.Printf("Stopped monitoring target %s", name)
+		}
+	}
+	for _, target := range targets {
+		if m, ok := s.monitors[target.Name]; ok {
+			if err := m.setConfig(target); err != nil {
+				log.Printf("Failed to apply config to target %s, keeping the current one: %v", target.Name, err)
+			}
+			continue
+		}
+		m, err := s.startMonitor(target)
+		if err != nil {
+			log.Printf("Failed to start monitoring target %s: %v", target.Name, err)
+			continue
+		}
+		started = append(started, m)
+		log.Printf("Started monitoring target %s", target.Name)
+	}
+
+	// Keep the startup-only settings as they are actually running, so that
+	// later reloads keep reporting them until the supervisor is restarted.
+	config.StartDelay = s.config.StartDelay
+	config.Workers = s.config.Workers
+	config.MetricsAddr = s.config.MetricsAddr
+	config.HistoryFile = s.config.HistoryFile
+	config.AdminAddr = s.config.AdminAddr
+	config.AdminTokens = s.config.AdminTokens
+	config.AdminTLS = s.config.AdminTLS
+	config.CloudWatch = s.config.CloudWatch
+	config.EventBridge = s.config.EventBridge
+	config.SelfUpdate = s.config.SelfUpdate
+	config.ChatOps = s.config.ChatOps
+	s.config = config
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// Metric modes.
+const (
+	metricModeHeight    = "height"
+	metricModeTimestamp = "timestamp"
+)
+
+// evaluateTimestamp handles a reading in timestamp mode, where the value is
+// the unix time of the latest block. The stall clock follows the block's own
+// time, so the stall duration is the block's age, except that it never moves
+// back past a restart or pause: a node that is still catching up gets a full
+// maxBlockAge after each restart. It reports whether the container was
+// restarted. The caller must hold m.mu.
+func (m *monitor) evaluateTimestamp(timestamp int64) bool {
+	blockTime := time.Unix(timestamp, 0)
+	m.logf("Latest block timestamp: %s (%v old)", blockTime.UTC().Format(time.RFC3339), time.Since(blockTime).Round(time.Second))
+	blockTimestampGauge.WithLabelValues(m.target).Set(float64(timestamp))
+
+	if timestamp > m.lastBlockHeight {
+		first := m.lastBlockHeight < 0
+		clock := m.lastProgressTime
+		m.progressed(timestamp)
+		m.lastProgressTime = clock
+		if first || blockTime.After(clock) {
+			m.lastProgressTime = blockTime
+		}
+	} else {
+		m.markStalled()
+	}
+
+	age := time.Since(m.lastProgressTime)
+	if maxAge := m.stallTimeout(); age > maxAge {
+		m.markStalled()
+		m.logf("Block timestamp stale for %v (max age: %v), restarting container", age.Round(time.Second), maxAge)
+		m.restart(reasonStall)
+		return true
+	}
+	return false
+}
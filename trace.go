@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// trace identifies what a log line or event belongs to: the target, the
+// evaluation cycle and, while one is in progress, the restart operation.
+type trace struct {
+	target  string
+	cycle   string
+	restart string
+}
+
+type traceKey struct{}
+
+// newTraceID returns a random ID for a cycle or restart, short enough to
+// grep for.
+func newTraceID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func withTrace(ctx context.Context, t trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) trace {
+	t, _ := ctx.Value(traceKey{}).(trace)
+	return t
+}
+
+// prefix is the log line prefix of t, e.g. "[mainnet cycle=1a2b3c4d5e6f] ".
+func (t trace) prefix() string {
+	if t.target == "" {
+		return ""
+	}
+	parts := []string{t.target}
+	if t.cycle != "" {
+		parts = append(parts, "cycle="+t.cycle)
+	}
+	if t.restart != "" {
+		parts = append(parts, "restart="+t.restart)
+	}
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// tracef logs with the prefix of the trace in ctx, if any, for code outside
+// the monitor that runs on its behalf.
+func tracef(ctx context.Context, format string, args ...interface{}) {
+	log.Print(traceFrom(ctx).prefix() + fmt.Sprintf(format, args...))
+}
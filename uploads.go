@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Actions on failing uploads.
+const (
+	uploadsNotify  = "notify"
+	uploadsRestart = "restart"
+)
+
+// UploadsConfig watches the lake indexer's S3 upload counters. The local
+// block height keeps increasing when uploads fail, so the bucket can fall
+// behind without a stall ever being detected.
+type UploadsConfig struct {
+	// ErrorMetric counts failed uploads. PutMetric, if set, counts
+	// successful ones, which makes MaxErrorRate the failing fraction of all
+	// uploads rather than errors per second.
+	ErrorMetric  string  `yaml:"errorMetric"`
+	PutMetric    string  `yaml:"putMetric"`
+	MaxErrorRate float64 `yaml:"maxErrorRate"`
+	// FailureTimeout is how long uploads have to keep failing before Action
+	// is taken: notify, or restart.
+	FailureTimeout time.Duration `yaml:"failureTimeout"`
+	Action         string        `yaml:"action"`
+}
+
+func (u UploadsConfig) enabled() bool {
+	return u.ErrorMetric != ""
+}
+
+func (u UploadsConfig) validate() error {
+	if !u.enabled() {
+		if u != (UploadsConfig{}) {
+			return fmt.Errorf("uploads: errorMetric is required")
+		}
+		return nil
+	}
+	if u.Action != uploadsNotify && u.Action != uploadsRestart {
+		return fmt.Errorf("uploads: unknown action %q", u.Action)
+	}
+	if u.MaxErrorRate < 0 || (u.PutMetric != "" && u.MaxErrorRate >= 1) {
+		return fmt.Errorf("uploads: maxErrorRate must be at least 0, and below 1 with putMetric")
+	}
+	return nil
+}
+
+// uploadCounters is a reading of the upload counters.
+type uploadCounters struct {
+	Errors float64   `json:"errors"`
+	Puts   float64   `json:"puts"`
+	At     time.Time `json:"at"`
+}
+
+// queryUploadCounters reads the upload counters from the indexer's metrics
+// endpoint, summed over all their series. A counter that is not exposed yet
+// reads as 0, since client libraries often only create it on first use.
+func queryUploadCounters(ctx context.Context, config TargetConfig) (counters uploadCounters, err error) {
+	start := time.Now()
+	defer func() { observeQuery(config.Name, sourcePrometheus, pathUploads, start, err) }()
+
+	families, err := fetchMetricFamilies(ctx, config.IndexerURL+"/metrics")
+	if err != nil {
+		return counters, err
+	}
+	counters.At = time.Now()
+	counters.Errors = sumMetric(families[config.Uploads.ErrorMetric])
+	counters.Puts = sumMetric(families[config.Uploads.PutMetric])
+	return counters, nil
+}
+
+func sumMetric(family *dto.MetricFamily) float64 {
+	var sum float64
+	for _, metric := range family.GetMetric() {
+		sum += metricValue(metric)
+	}
+	return sum
+}
+
+// increase is the increase of a counter between two readings, allowing for
+// the counter being reset by a restart of the indexer.
+func increase(previous, current float64) float64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// checkUploads compares this cycle's upload counters with the previous
+// reading and applies the upload failure policy, reporting whether the
+// container was restarted. Without putMetric uploads fail when errors exceed
+// maxErrorRate per second; with it, when more than that fraction of uploads
+// fails, or when nothing was uploaded while the block height progressed. The
+// caller must hold m.mu.
+func (m *monitor) checkUploads(counters uploadCounters, err error, progressed bool) bool {
+	config := m.config.Uploads
+	if !config.enabled() {
+		return false
+	}
+	if err != nil {
+		m.logf("Warning: Failed to query upload counters: %v", err)
+		return false
+	}
+	previous := m.uploads
+	m.uploads = &counters
+	if previous == nil {
+		return false
+	}
+
+	errors := increase(previous.Errors, counters.Errors)
+	var failure string
+	if config.PutMetric != "" {
+		total := errors + increase(previous.Puts, counters.Puts)
+		var ratio float64
+		if total > 0 {
+			ratio = errors / total
+		}
+		uploadErrorRateGauge.WithLabelValues(m.target).Set(ratio)
+		switch {
+		case total == 0 && progressed:
+			failure = "nothing uploaded while the block height progresses"
+		case errors > 0 && ratio > config.MaxErrorRate:
+			failure = fmt.Sprintf("%.0f of %.0f uploads failed", errors, total)
+		}
+	} else {
+		var rate float64
+		if elapsed := counters.At.Sub(previous.At).Seconds(); elapsed > 0 {
+			rate = errors / elapsed
+		}
+		uploadErrorRateGauge.WithLabelValues(m.target).Set(rate)
+		if errors > 0 && rate > config.MaxErrorRate {
+			failure = fmt.Sprintf("%.0f upload errors, %.2f/s", errors, rate)
+		}
+	}
+
+	if failure == "" {
+		if !m.uploadsFailingSince.IsZero() {
+			m.logf("Uploads succeeding again after failing for %v", time.Since(m.uploadsFailingSince).Round(time.Second))
+			if m.uploadsNotified {
+				m.recordUploads(outcomeRecovered, "")
+			}
+		}
+		m.uploadsFailingSince = time.Time{}
+		m.uploadsError = ""
+		m.uploadsNotified = false
+		uploadsUpGauge.WithLabelValues(m.target).Set(1)
+		return false
+	}
+
+	if m.uploadsFailingSince.IsZero() {
+		m.uploadsFailingSince = time.Now()
+	}
+	m.uploadsError = failure
+	uploadsUpGauge.WithLabelValues(m.target).Set(0)
+	failing := time.Since(m.uploadsFailingSince)
+	m.logf("Uploads failing for %v: %s", failing.Round(time.Second), failure)
+	if failing < config.FailureTimeout {
+		return false
+	}
+
+	if !m.uploadsNotified {
+		m.recordUploads(outcomeFailing, failure)
+		m.uploadsNotified = true
+	}
+	if config.Action != uploadsRestart {
+		return false
+	}
+	m.logf("Uploads have been failing for more than %v, restarting container", config.FailureTimeout)
+	m.restart(reasonUploadFailure)
+	// Give the restarted indexer a full failure timeout of its own.
+	m.uploadsFailingSince = time.Time{}
+	m.uploadsNotified = false
+	return true
+}
+
+func (m *monitor) recordUploads(outcome, failure string) {
+	m.record(historyEvent{
+		Target:      m.target,
+		Type:        eventUploads,
+		BlockHeight: m.lastBlockHeight,
+		Outcome:     outcome,
+		Duration:    time.Since(m.uploadsFailingSince),
+		Error:       failure,
+	})
+}
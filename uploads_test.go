@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckUploads(t *testing.T) {
+	const failureTimeout = 10 * time.Minute
+	start := time.Now().Add(-time.Minute)
+	ratio := UploadsConfig{ErrorMetric: "errors", PutMetric: "puts", MaxErrorRate: 0.1, FailureTimeout: failureTimeout, Action: uploadsRestart}
+	rate := UploadsConfig{ErrorMetric: "errors", MaxErrorRate: 0.5, FailureTimeout: failureTimeout, Action: uploadsNotify}
+	reading := func(errors, puts float64) uploadCounters {
+		return uploadCounters{Errors: errors, Puts: puts, At: start.Add(time.Minute)}
+	}
+	previous := &uploadCounters{Errors: 100, Puts: 1000, At: start}
+
+	tests := []struct {
+		name          string
+		config        UploadsConfig
+		previous      *uploadCounters
+		counters      uploadCounters
+		err           error
+		progressed    bool
+		failingSince  time.Duration
+		notified      bool
+		restarted     bool
+		failing       bool
+		outcomes      []string
+		keepsPrevious bool
+	}{
+		{name: "first reading", config: ratio, counters: reading(150, 1000)},
+		{name: "query error", config: ratio, previous: previous, counters: reading(150, 1000), err: errors.New("timeout"), keepsPrevious: true},
+		{name: "healthy", config: ratio, previous: previous, counters: reading(105, 1100), progressed: true},
+		{name: "error ratio exceeded", config: ratio, previous: previous, counters: reading(150, 1100), progressed: true, failing: true},
+		{name: "nothing uploaded while progressing", config: ratio, previous: previous, counters: reading(100, 1000), progressed: true, failing: true},
+		{name: "nothing uploaded while stalled", config: ratio, previous: previous, counters: reading(100, 1000)},
+		{name: "counter reset", config: ratio, previous: previous, counters: reading(1, 50), progressed: true},
+		{name: "failing past the timeout", config: ratio, previous: previous, counters: reading(150, 1100), failingSince: 2 * failureTimeout, restarted: true, outcomes: []string{outcomeFailing}},
+		{name: "recovered", config: ratio, previous: previous, counters: reading(100, 1100), failingSince: 2 * failureTimeout, notified: true, outcomes: []string{outcomeRecovered}},
+		{name: "error rate within limit", config: rate, previous: previous, counters: reading(120, 0)},
+		{name: "error rate exceeded", config: rate, previous: previous, counters: reading(160, 0), failing: true},
+		{name: "error rate past the timeout", config: rate, previous: previous, counters: reading(160, 0), failingSince: 2 * failureTimeout, failing: true, outcomes: []string{outcomeFailing}},
+	}
+	for _, test := range tests {
+		m, events := newTestMonitor(TargetConfig{Uploads: test.config})
+		m.uploads = test.previous
+		if test.failingSince > 0 {
+			m.uploadsFailingSince = time.Now().Add(-test.failingSince)
+		}
+		m.uploadsNotified = test.notified
+
+		if restarted := m.checkUploads(test.counters, test.err, test.progressed); restarted != test.restarted {
+			t.Errorf("%s: checkUploads() = %v, want %v", test.name, restarted, test.restarted)
+		}
+		if failing := !m.uploadsFailingSince.IsZero(); failing != test.failing {
+			t.Errorf("%s: failing = %v, want %v", test.name, failing, test.failing)
+		}
+		if outcomes := events.outcomes(); !reflect.DeepEqual(outcomes, test.outcomes) {
+			t.Errorf("%s: recorded %v, want %v", test.name, outcomes, test.outcomes)
+		}
+		if test.keepsPrevious && m.uploads != test.previous {
+			t.Errorf("%s: replaced the previous reading", test.name)
+		}
+		if !test.keepsPrevious && (m.uploads == nil || *m.uploads != test.counters) {
+			t.Errorf("%s: kept %v, want the reading %v", test.name, m.uploads, test.counters)
+		}
+	}
+}